@@ -0,0 +1,136 @@
+package bbq
+
+import (
+	"unicode/utf8"
+)
+
+// 广播的选项，nil 为发送给所有的目标
+type BroadcastOptions struct {
+	// 不发送给调用 Chum.Broadcast 的连接
+	ExcludeSelf bool
+	// 不发送给 Register 了这些 id 的连接
+	Exclude []string
+	// 只发送给返回 true 的连接（可通过 Get 读取属性），在发送的线程中调用，不要阻塞
+	Filter func(chum Chum) bool
+	// 延迟发送时，相同 Key 的广播只发送最新的一个（如状态的更新），发送时间为第一个的时间；
+	// 为空时只合并完全相同的广播（发送者、数据和选项都相同，设置了 Filter 的不会合并）
+	Key string
+}
+
+// 延迟发送时判断两个广播的选项是否相同，nil 与零值相同。
+// Filter 无法比较，只有都为 nil 时才相同；Exclude 需要顺序也相同
+func (self *BroadcastOptions) equal(o *BroadcastOptions) bool {
+	if self == o {
+		return true
+	}
+	var zero BroadcastOptions
+	if nil == self {
+		self = &zero
+	}
+	if nil == o {
+		o = &zero
+	}
+	if nil != self.Filter || nil != o.Filter || self.ExcludeSelf != o.ExcludeSelf || self.Key != o.Key || len(self.Exclude) != len(o.Exclude) {
+		return false
+	}
+	for i, id := range self.Exclude {
+		if id != o.Exclude[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 每次发送时由 BroadcastOptions 构建一次，Exclude 转为集合，避免每个成员都遍历一遍
+type matcher struct {
+	opts    *BroadcastOptions
+	exclude map[string]struct{}
+}
+
+func (self *BroadcastOptions) matcher() matcher {
+	m := matcher{opts: self}
+	if nil != self && len(self.Exclude) != 0 {
+		m.exclude = make(map[string]struct{}, len(self.Exclude))
+		for _, id := range self.Exclude {
+			m.exclude[id] = struct{}{}
+		}
+	}
+	return m
+}
+
+func (self *matcher) match(sender, chum *chum) bool {
+	opts := self.opts
+	if nil == opts {
+		return true
+	}
+	if opts.ExcludeSelf && chum == sender {
+		return false
+	}
+	if nil != self.exclude {
+		if id := chum.Id(); id != "" {
+			if _, ok := self.exclude[id]; ok {
+				return false
+			}
+		}
+	}
+	return nil == opts.Filter || opts.Filter(chum)
+}
+
+// 为广播构建帧（只构建、压缩一次），cbs 为压缩后的帧（不需要压缩时为 nil），用完后需调用 putFrames
+func (self *party) broadcastFrames(b []byte, text bool) (bs, cbs *frameBuf, err error) {
+	if text && self.validateUTF8 && !utf8.Valid(b) {
+		return nil, nil, Error_utf8
+	}
+	op := byte(0x82)
+	if text {
+		op = 0x81
+	}
+	b1, b2 := self.frames(b, op)
+	bs = newFrameBuf(b1)
+	if nil != b2 {
+		cbs = newFrameBuf(b2)
+	}
+	return
+}
+
+// 释放构建时的引用，写不完的连接仍持有各自的引用
+func putFrames(bs, cbs *frameBuf) {
+	bs.release()
+	if nil != cbs {
+		cbs.release()
+	}
+}
+
+// 协商了压缩的连接发送 cbs，返回需要关闭连接的错误（见 writeShared）
+func (self *chum) writeFrames(bs, cbs *frameBuf) error {
+	if nil != cbs && nil != self.deflate {
+		return self.writeShared(cbs)
+	}
+	return self.writeShared(bs)
+}
+
+func (self *party) Multicast(ids []string, b []byte, text bool, opts *BroadcastOptions) error {
+	chums := make([]*chum, 0, len(ids))
+	self.chumsLK.RLock()
+	for _, id := range ids {
+		if chum, ok := self.chumsMap[id]; ok {
+			chums = append(chums, chum)
+		}
+	}
+	self.chumsLK.RUnlock()
+	if len(chums) == 0 {
+		return nil
+	}
+	bs, cbs, err := self.broadcastFrames(b, text)
+	if nil != err {
+		return err
+	}
+	m := opts.matcher()
+	for _, chum := range chums {
+		if m.match(nil, chum) {
+			chum.writeFailed(chum.writeFrames(bs, cbs))
+		}
+	}
+	putFrames(bs, cbs)
+	return nil
+}
@@ -3,109 +3,212 @@ package bbq
 import (
 	"fmt"
 	"github.com/gobwas/pool/pbytes"
+	"github.com/ikCourage/autumn/bbq/wire"
 	"github.com/ikCourage/autumn/kpoll"
+	"github.com/ikCourage/autumn/pooll"
 	"github.com/ikCourage/autumn/timer"
 	"io"
-	"io/ioutil"
 	"net"
+	"runtime/debug"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 const (
-	header_fin  = 0x80
-	header_mask = 0x40
-	header_read = 0x20
-
-	flag_action  = 0x1
-	flag_length  = 0x2
-	flag_data    = 0x4
-	flag_all     = 0x8
-	flag_stream  = 0x10
-	flag_again   = 0x20
-	flag_discard = 0x80
+	flag_stream   = 0x1
+	flag_again    = 0x2
+	flag_received = 0x4 // 消息已读完
 )
 
 var (
-	Error_notsupport_rsv      = fmt.Errorf("not support rsv")
-	Error_notsupport_length64 = fmt.Errorf("not support 64-bit length")
-	Error_opcode              = fmt.Errorf("error opcode")
+	Error_notsupport_rsv      = wire.Error_notsupport_rsv
+	Error_notsupport_length64 = wire.Error_notsupport_length64
+	Error_too_large           = wire.Error_too_large
+	Error_opcode              = wire.Error_opcode
+	Error_control             = wire.Error_control
+	Error_unmasked            = wire.Error_unmasked
+	Error_continuation        = wire.Error_continuation
+	Error_utf8                = fmt.Errorf("invalid utf-8 text")
+	Error_close_code          = fmt.Errorf("invalid close code")
 	Error_closed              = fmt.Errorf("the connection is closed")
+	Error_backlog             = fmt.Errorf("too many pending bytes")
 
-	Error_action_notfound = fmt.Errorf("action not found")
-	Error_action          = fmt.Errorf("action must be less than 32 bits")
-	Error_length          = fmt.Errorf("length must be less than 16 bits")
-	Error_notenough       = fmt.Errorf("the length is not enough")
+	Error_action_notfound = wire.Error_action_notfound
+	Error_action          = wire.Error_action
+	Error_length          = wire.Error_length
+	Error_notenough       = wire.Error_notenough
 )
 
 var (
 	frame_ping = []byte{0x89, 0}
-	frame_pong = []byte{0x8A, 0}
 )
 
 var (
-	PBytes = pbytes.New(2, 65536)
+	PBytes = pbytes.New(2, max_message_size)
 )
 
 const (
-	ActionType_discard = 0
-	ActionType_vlen    = -1
-	ActionType_stream  = -2
-	ActionType_all     = -3
+	// 默认的最大消息长度
+	max_message_size = 1 << 22
+	// 每次读取的长度
+	read_size = 1 << 14
+)
+
+const (
+	// 应用调用 Close
+	CloseType_normal = iota
+	// 长时间没有有效的通信
+	CloseType_timeout
+	// 对端发送了关闭帧
+	CloseType_peer
+	// 协议错误（Error_opcode、Error_notsupport_rsv 等）
+	CloseType_protocol
+	// 相同 id 重复 Register，旧连接被踢掉
+	CloseType_kicked
+	// Party 关闭
+	CloseType_shutdown
+	// OnConnect 拒绝了连接
+	CloseType_reject
+	// 读写出错或连接断开
+	CloseType_error
+	// handler panic（以 1011 关闭，Err 为 *PanicError）
+	CloseType_panic
+	// 待写的数据超出 Config.MaxPending（SlowPolicy_close，以 1008 关闭）
+	CloseType_slow
+)
+
+// 连接关闭的原因
+type CloseReason struct {
+	Type int
+	// 关闭帧中的状态码（对端发送的或服务端发送的）
+	Code int
+	// 关闭帧中的原因（对端发送的或 CloseWithCode、Kick 给出的）
+	Reason string
+	Err    error
+}
+
+// handler 中的 panic，通过 OnError 及 CloseReason.Err 报告
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (self *PanicError) Error() string {
+	return fmt.Sprintf("handler panic: %v", self.Value)
+}
+
+type closeEvent struct {
+	chum   *chum
+	reason CloseReason
+}
+
+const (
+	ActionType_discard = wire.ActionType_discard
+	ActionType_vlen    = wire.ActionType_vlen
+	ActionType_stream  = wire.ActionType_stream
+	ActionType_all     = wire.ActionType_all
 )
 
 type Router struct {
-	Type    int32
-	Action  uint32
+	Type   int32
+	Action uint32
+	// 开启 Config.NamedActions 时，由服务端为该名称分配 Action
+	Name    string
 	Handler func(chum Chum)
+	// 只作用于该 router 的中间件，在 Party.Use 的中间件之后调用
+	Middlewares []Middleware
+
+	handler func(chum Chum) // 加上中间件之后的 handler
 }
 
+// 中间件包装 handler，不调用 next 即可拦截该消息。
+// ActionType_stream 的 handler 每次读到数据都会调用（First、Received 区分首尾），
+// 未结束时连接关闭还会再调用一次（Closed 为 true），中间件也同样会被调用
+type Middleware func(next func(chum Chum)) func(chum Chum)
+
 type chum struct {
 	net.Conn
-	id            string
-	prev          *chum
-	next          *chum
-	aprev         *chum
-	anext         *chum
-	party         *party
-	team          *team
-	handler       func(chum Chum)
-	mask          [8]byte // 也用于 header 的缓冲
-	payloadOffset uint32  // 当前已读的偏移量
-	payloadLength uint32  // 有效数据长度
-	offset        uint32  // 应用数据偏移量
-	length        uint32  // 应用数据长度
-	action        uint32
-	flags         uint8 // 标志 action length 等是否准备好
-	header        uint8
-	opCode        uint8
-	_             uint8
-	readBuf       []byte
-	writeBuf      []byte
-	writeLK       sync.Mutex
-	writeOffset   uint32
-	reading       uint32
-	closed        uint32
-	active        int64
-	fd            int
+	id          atomic.Value // Register 的 id（string），广播时在其它线程读取
+	aprev       *chum
+	anext       *chum
+	party       *party
+	teamsLK     sync.Mutex
+	teams       map[string]*team // 加入的 team，在 poollTeam 中变更
+	request     *Request
+	claims      interface{}
+	attrsLK     sync.RWMutex
+	attrs       map[string]interface{}
+	handler     func(chum Chum)
+	frame       wire.FrameDecoder
+	message     wire.ActionDecoder
+	size        uint64 // 当前消息已收到的长度（各帧之和）
+	offset      uint32 // 应用数据偏移量
+	length      uint32 // 应用数据长度
+	action      uint32
+	flags       uint8 // 标志 stream 等状态
+	utf8        uint8 // 文本消息的 UTF-8 校验状态
+	readBuf     []byte
+	chunk       []byte     // stream 本次读到的数据
+	writeQueue  []outbound // 待写的数据
+	writeLK     sync.Mutex
+	writeOffset int        // writeQueue 队首已写的字节数
+	writeErr    error      // 写入的错误，释放 writeLK 后关闭连接
+	writeCond   *sync.Cond // SlowPolicy_block 时等待队列的空间
+	backlog     int64      // writeQueue 中未写的字节数
+	reading     uint32
+	discard     bool   // 关闭握手期间丢弃读到的数据，只由读线程访问
+	closing     uint32 // 关闭握手的状态（closing_sent、closing_done）
+	closed      uint32
+	closeReason CloseReason
+	ctrlBuf     []byte // 控制帧的数据
+	deflate     *deflate
+	calls       wire.Calls // 等待回复的 RPC
+	active      int64
+	fd          int
 }
 
 type Chum interface {
 	Close() error
+	// 发送关闭帧后关闭连接（待写数据写完之后），
+	// code 非法时返回 Error_close_code，reason 不是合法的 UTF-8 时返回 Error_utf8
+	CloseWithCode(code int, reason string) error
 	Read(b []byte) (int, error)
 	Write(b []byte) (int, error)
 
+	Id() string
+	// 握手时的请求（未配置 Authorize 时为 nil）
+	Request() *Request
+	// Authorize 返回的 claims
+	Claims() interface{}
 	Register(id string)
+
+	// 连接级别的属性，关闭时自动丢弃（可在任意线程调用）
+	Set(key string, value interface{})
+	Get(key string) interface{}
+	Delete(key string)
 	GetChumById(id string) Chum
 
+	// 加入、离开 team 都是异步的，按调用的顺序生效；连接关闭时自动离开所有的 team
 	Join(id string)
-	Leave()
-	Broadcast(b []byte, text bool, delay time.Duration) error
+	Leave(id string)
+	LeaveAll()
+	// 已加入的 team
+	Teams() []string
+	// 发送给已加入的 team id 的成员，opts 为 nil 时发送给所有成员（包括自己）。
+	// delay 小于 0 时立刻发送，否则延迟 delay（0 为 1 秒）发送，并合并等待中的广播（见 BroadcastOptions.Key）
+	Broadcast(id string, b []byte, text bool, delay time.Duration, opts *BroadcastOptions) error
+	// 调用客户端的 RPC（见 RPC），callback 在收到回复、超时或连接关闭时调用，
+	// resp 只在回调中有效
+	Call(action uint32, req []byte, timeout time.Duration, callback func(resp []byte, err error)) error
 	WriteFrame(b []byte, text bool) (int, error)
 
 	Closed() bool
+	// 已排队还未写入 socket 的字节数（可在任意线程调用）
+	Backlog() int
 	First() bool
 	Received() bool
 
@@ -114,16 +217,24 @@ type Chum interface {
 	Data() []byte
 }
 
-func (self *chum) close(locked bool) (err error) {
+// locked 为 true 时，调用者已持有 chumsLK，OnClose 会在 flushClosed 时回调
+func (self *chum) close(locked bool, reason CloseReason) (err error) {
 	if !atomic.CompareAndSwapUint32(&self.closed, 0, 1) {
 		return Error_closed
 	}
+	party := self.party
+	if atomic.LoadUint32(&self.closing) != 0 {
+		// 以发送关闭帧时的原因为准
+		reason = self.closeReason
+	}
 	if !locked {
 		self.party.chumsLK.Lock()
 	}
-	if self.id != "" {
-		delete(self.party.chumsMap, self.id)
-		self.id = ""
+	if id := self.Id(); id != "" {
+		// id 保留，以便 OnClose 中仍可获取
+		if self == self.party.chumsMap[id] {
+			delete(self.party.chumsMap, id)
+		}
 	}
 	delete(self.party.chums, self.fd)
 	if nil != self.anext {
@@ -141,51 +252,130 @@ func (self *chum) close(locked bool) (err error) {
 		self.party.cursor = self.anext
 	}
 	self.party.kpoller.Del(self.fd)
+	if locked && nil != party.onClose {
+		party.closedEvents = append(party.closedEvents, closeEvent{self, reason})
+	}
 	if !locked {
 		self.party.chumsLK.Unlock()
 	}
-	if team := self.team; nil != team {
-		team.remove(self)
-	}
-	if nil != self.readBuf {
-		PBytes.Put(self.readBuf)
-		self.readBuf = nil
+	party.leaveAll(self)
+	self.writeLK.Lock()
+	self.releaseQueue()
+	self.writeLK.Unlock()
+	err = self.Conn.Close()
+	// 在其它线程回调，因为 close 时可能持有锁
+	self.calls.Close(Error_closed)
+	if !locked && nil != party.onClose {
+		guard("OnClose", func() {
+			party.onClose(self, reason)
+		})
 	}
-	if nil != self.writeBuf {
-		PBytes.Put(self.writeBuf)
-		self.writeBuf = nil
+	if !locked || nil == party.onClose {
+		// onClose 之后才丢弃，以便回调中仍可读取属性
+		self.clearAttrs()
 	}
-	err = self.Conn.Close()
 	self.aprev = nil
 	self.anext = nil
-	self.party = nil
-	if nil != self.handler && self.flags&flag_stream != 0 {
-		self.handler(self)
-		self.handler = nil
+	if atomic.CompareAndSwapUint32(&self.reading, 0, 1) {
+		// 没有线程在读，直接释放读相关的资源，否则由读线程释放
+		self.releaseRead()
 	}
-	self.flags = 0
 	return
 }
 
 func (self *chum) Close() error {
-	return self.close(false)
+	return self.CloseWithCode(CloseCode_normal, "")
+}
+
+func (self *chum) CloseWithCode(code int, reason string) error {
+	if err := checkClose(code, reason); nil != err {
+		return err
+	}
+	return self.closeWithCode(false, code, reason, CloseReason{Type: CloseType_normal, Code: code, Reason: reason})
+}
+
+// 报告错误并关闭连接，返回 err 以便调用者直接返回。
+// code 为 0 时不发送关闭帧（例如连接已断开）
+func (self *chum) fail(typ int, code int, err error) error {
+	if party := self.party; nil != party && nil != party.onError && !self.Closed() {
+		guard("OnError", func() {
+			party.onError(self, err)
+		})
+	}
+	if code == 0 {
+		self.close(false, CloseReason{Type: typ, Err: err})
+	} else {
+		self.closeWithCode(false, code, "", CloseReason{Type: typ, Code: code, Err: err})
+	}
+	return err
 }
 
 func (self *chum) Closed() bool {
 	return atomic.LoadUint32(&self.closed) == 1
 }
 
-func (self *chum) Register(id string) {
-	if self.id == "" {
-		self.id = id
-		self.party.chumsLK.Lock()
-		chum, ok := self.party.chumsMap[id]
-		if ok {
-			chum.close(true)
+func (self *chum) Id() string {
+	id, _ := self.id.Load().(string)
+	return id
+}
+
+func (self *chum) Request() *Request {
+	return self.request
+}
+
+func (self *chum) Claims() interface{} {
+	return self.claims
+}
+
+func (self *chum) Set(key string, value interface{}) {
+	self.attrsLK.Lock()
+	if !self.Closed() {
+		if nil == self.attrs {
+			self.attrs = make(map[string]interface{})
 		}
-		self.party.chumsMap[id] = self
-		self.party.chumsLK.Unlock()
+		self.attrs[key] = value
+	}
+	self.attrsLK.Unlock()
+}
+
+func (self *chum) Get(key string) (value interface{}) {
+	self.attrsLK.RLock()
+	if nil != self.attrs {
+		value = self.attrs[key]
 	}
+	self.attrsLK.RUnlock()
+	return
+}
+
+func (self *chum) Delete(key string) {
+	self.attrsLK.Lock()
+	if nil != self.attrs {
+		delete(self.attrs, key)
+	}
+	self.attrsLK.Unlock()
+}
+
+func (self *chum) clearAttrs() {
+	self.attrsLK.Lock()
+	self.attrs = nil
+	self.attrsLK.Unlock()
+}
+
+func (self *chum) Register(id string) {
+	party := self.party
+	party.chumsLK.Lock()
+	if self.Id() != "" {
+		party.chumsLK.Unlock()
+		return
+	}
+	self.id.Store(id)
+	chum, ok := party.chumsMap[id]
+	if ok {
+		chum.closeWithCode(true, CloseCode_policy, "", CloseReason{Type: CloseType_kicked, Code: CloseCode_policy})
+	}
+	party.chumsMap[id] = self
+	party.chumsLK.Unlock()
+	party.flushClosed()
 }
 
 func (self *chum) GetChumById(id string) Chum {
@@ -199,31 +389,34 @@ func (self *chum) GetChumById(id string) Chum {
 }
 
 func (self *chum) Join(id string) {
-	if team := self.team; nil != team {
-		if id == team.id {
-			return
-		}
-		team.remove(self)
-	}
-	self.party.teamsLK.Lock()
-	team, ok := self.party.teams[id]
-	if !ok {
-		team = newTeam(self.party, id)
-		self.party.teams[id] = team
-	}
-	team.add(self)
-	self.party.teamsLK.Unlock()
+	self.party.join(self, id)
+}
+
+func (self *chum) Leave(id string) {
+	self.party.leave(self, id)
 }
 
-func (self *chum) Leave() {
-	if team := self.team; nil != team {
-		team.remove(self)
+func (self *chum) LeaveAll() {
+	self.party.leaveAll(self)
+}
+
+func (self *chum) Teams() []string {
+	self.teamsLK.Lock()
+	ids := make([]string, 0, len(self.teams))
+	for id := range self.teams {
+		ids = append(ids, id)
 	}
+	self.teamsLK.Unlock()
+	sort.Strings(ids)
+	return ids
 }
 
-func (self *chum) Broadcast(b []byte, text bool, delay time.Duration) error {
-	if team := self.team; nil != team {
-		return team.broadcast(self, b, text, delay)
+func (self *chum) Broadcast(id string, b []byte, text bool, delay time.Duration, opts *BroadcastOptions) error {
+	self.teamsLK.Lock()
+	team := self.teams[id]
+	self.teamsLK.Unlock()
+	if nil != team {
+		return team.broadcast(self, b, text, delay, opts)
 	}
 	return nil
 }
@@ -233,13 +426,7 @@ func (self *chum) First() bool {
 }
 
 func (self *chum) Received() bool {
-	if self.header&header_fin != 0 {
-		if self.flags&flag_stream != 0 {
-			return self.payloadOffset == self.payloadLength
-		}
-		return self.offset == self.length
-	}
-	return false
+	return self.flags&flag_received != 0
 }
 
 func (self *chum) Action() uint32 {
@@ -251,6 +438,10 @@ func (self *chum) Length() uint32 {
 }
 
 func (self *chum) Data() []byte {
+	if self.flags&flag_stream != 0 {
+		// 渐进流只返回本次读到的数据
+		return self.chunk
+	}
 	return self.readBuf
 }
 
@@ -261,7 +452,7 @@ func (self *chum) Read(b []byte) (int, error) {
 		switch err {
 		case syscall.EAGAIN, syscall.EINTR:
 		default:
-			self.Close()
+			self.fail(CloseType_error, 0, err)
 		}
 	} else if n <= 0 {
 		err = syscall.EAGAIN
@@ -271,16 +462,25 @@ func (self *chum) Read(b []byte) (int, error) {
 
 func (self *chum) write(b []byte) (int, error) {
 	n, err := syscall.Write(self.fd, b)
+	return self.written(n, err)
+}
+
+func (self *chum) writev(iovs [][]byte) (int, error) {
+	n, err := writev(self.fd, iovs)
+	return self.written(n, err)
+}
+
+// 处理写入的结果，写不进去时开始侦听 write
+func (self *chum) written(n int, err error) (int, error) {
 	if nil != err {
 		n = 0
 		switch err {
 		case syscall.EAGAIN, syscall.EINTR:
-			if nil == self.writeBuf {
-				// #ctr 开始侦听 write
-				self.party.kpoller.Mod(self.fd, kpoll.KEV_WRITE|kpoll.KEF_ET)
-			}
+			// #ctr 开始侦听 write
+			self.party.kpoller.Mod(self.fd, kpoll.KEV_WRITE|kpoll.KEF_ET)
 		default:
-			self.Close()
+			// 持有 writeLK，由 unlockWrite 关闭连接
+			self.writeErr = err
 		}
 	} else if n <= 0 {
 		err = syscall.EAGAIN
@@ -289,389 +489,444 @@ func (self *chum) write(b []byte) (int, error) {
 }
 
 func (self *chum) Write(b []byte) (nn int, err error) {
-	var n int
-	nn = len(b)
 	self.writeLK.Lock()
-	if nil == self.writeBuf {
-		// 尝试写一次
-		n, err = self.write(b)
-		if nil != err {
-			switch err {
-			case syscall.EAGAIN, syscall.EINTR:
-			default:
-				self.writeLK.Unlock()
-				return n, err
-			}
-		}
-		if n < nn {
-			n = nn - n
-			self.writeOffset = uint32(n)
-			self.writeBuf = PBytes.Get(0, n)
-			self.writeBuf = self.writeBuf[:cap(self.writeBuf)]
-			copy(self.writeBuf, b)
-
-			if nil == err {
-				// 加入写线程
-				self.party.poollWrite.Put(self)
-			}
-		}
-	} else {
-		n = cap(self.writeBuf)
-		if nn > n-int(self.writeOffset) {
-			buf := self.writeBuf
-			self.writeBuf = PBytes.Get(0, int(self.writeOffset)+nn)
-			self.writeBuf = self.writeBuf[:cap(self.writeBuf)]
-			copy(self.writeBuf, buf[:self.writeOffset])
-			PBytes.Put(buf)
-		}
-		copy(self.writeBuf[self.writeOffset:], b)
-		self.writeOffset += uint32(nn)
+	if self.closing != 0 || self.Closed() {
+		// 关闭帧之后（或已关闭）不能再发送数据
+		self.unlockWrite()
+		return 0, Error_closed
 	}
-	self.writeLK.Unlock()
+	if err = self.admit(len(b), false); nil != err {
+		self.unlockWrite()
+		return
+	}
+	nn, err = self.writeLocked(b)
+	self.unlockWrite()
 	return
 }
 
-func (self *chum) WriteFrame(b []byte, text bool) (int, error) {
-	header := [4]byte{0x82, 0x7E}
+func (self *chum) WriteFrame(b []byte, text bool) (n int, err error) {
+	if text && self.party.validateUTF8 && !utf8.Valid(b) {
+		return 0, Error_utf8
+	}
+	var header [10]byte
+	op := byte(0x82)
 	if text {
-		header[0] = 0x81
+		op = 0x81
 	}
-	l := len(b)
-	switch {
-	case l < 0x7E:
-		header[1] = byte(l)
-		l = 2
-	case l <= 0xFFFF:
-		header[2] = byte(l >> 8)
-		header[3] = byte(l & 0xFF)
-		l = 4
-	default:
-		return 0, Error_notsupport_length64
+	if nil != self.deflate && len(b) >= self.party.compressor.config.Threshold {
+		c := self.party.compressor.compress(b)
+		l := frameHeader(header[:], op|0x40, len(c))
+		if _, err = self.writeFrame(header[:l], c); nil == err {
+			n = len(b)
+		}
+		PBytes.Put(c)
+		return
 	}
-	self.Write(header[:l])
-	return self.Write(b)
+	l := frameHeader(header[:], op, len(b))
+	return self.writeFrame(header[:l], b)
 }
 
-func (self *chum) writeLoop() error {
+// 帧头与数据一起写入，防止与其它线程的写入交错
+func (self *chum) writeFrame(header, b []byte) (int, error) {
 	self.writeLK.Lock()
-	n, err := self.write(self.writeBuf[:self.writeOffset])
-	if nil != err {
-		self.writeLK.Unlock()
-		return err
+	defer self.unlockWrite()
+	if self.closing != 0 || self.Closed() {
+		return 0, Error_closed
 	}
-	if n != int(self.writeOffset) {
-		copy(self.writeBuf, self.writeBuf[n:self.writeOffset])
-		self.writeOffset -= uint32(n)
-	} else {
-		PBytes.Put(self.writeBuf)
-		self.writeBuf = nil
-		// #ctr 重新侦听 read
-		self.party.kpoller.Mod(self.fd, kpoll.KEV_READ|kpoll.KEF_ET)
+	if err := self.admit(len(header)+len(b), false); nil != err {
+		return 0, err
 	}
-	self.writeLK.Unlock()
-	return err
+	if _, err := self.writeLocked(header); nil != err {
+		return 0, err
+	}
+	return self.writeLocked(b)
 }
 
-func (self *chum) readHeader() (err error) {
-	// if self.header&header_read != 0 {
-	// 	return
-	// }
+// 写入帧头（不含 mask），返回帧头的长度，header 至少 10 字节
+func frameHeader(header []byte, b0 byte, l int) int {
+	return len(wire.AppendHeader(header[:0], wire.Header{
+		Fin:    b0&0x80 != 0,
+		Rsv:    b0 & 0x70,
+		OpCode: b0 & 0x0F,
+		Length: uint64(l),
+	}))
+}
+
+// 读取并解析数据。每次只读一次，没有出错则重新加入读线程，
+// 直到 EAGAIN 时等待下一次的 read 事件
+func (self *chum) readLoop() {
 	var n int
-	bs := self.mask[:]
-__retry:
-	if self.payloadOffset < 2 {
-		// 读取头两个字节
-		n, err = self.Read(bs[self.payloadOffset:2])
-		if nil != err {
-			return
+	var err error
+	var bs []byte
+	// 同一时刻，只有一个线程可以读
+	if !atomic.CompareAndSwapUint32(&self.reading, 0, 1) {
+		if !self.Closed() {
+			self.party.poollRead.Put(self)
 		}
-		self.payloadOffset += uint32(n)
-		if self.payloadOffset == 2 {
-			if bs[0]&0x70 != 0 {
-				// 不支持 rsv
-				self.Close()
-				return Error_notsupport_rsv
-			}
-			self.header = bs[0] & header_fin
-			self.opCode = bs[0] & 0x0F
-			bs[0] = 2
-			if bs[1]&0x80 != 0 {
-				self.header |= header_mask
-				bs[0] += 4
-			}
-			self.payloadLength = uint32(bs[1] & 0x7F)
-			switch {
-			case self.payloadLength < 126:
-			case self.payloadLength == 126:
-				bs[0] += 2
-			default:
-				// 不支持长数据
-				self.Close()
-				return Error_notsupport_length64
-			}
-			switch self.opCode {
-			case 0x0, 0x1, 0x2, 0x9, 0xA:
-			case 0x8:
-				self.Close()
-				return Error_closed
-			default:
-				self.Close()
-				return Error_opcode
+		return
+	}
+	defer func() {
+		if v := recover(); nil != v {
+			// 不能让 reading 停留在 1，否则之后的读事件会一直重新加入读线程
+			atomic.StoreUint32(&self.reading, 0)
+			self.fail(CloseType_panic, CloseCode_internal, &PanicError{Value: v, Stack: debug.Stack()})
+			if atomic.CompareAndSwapUint32(&self.reading, 0, 1) {
+				self.releaseRead()
 			}
-		} else {
-			return
 		}
+	}()
+	if self.Closed() {
+		// 关闭之前已加入读线程的事件
+		goto __end
 	}
-	if self.payloadOffset < uint32(bs[0]) {
-		n, err = self.Read(bs[self.payloadOffset:bs[0]])
-		if nil != err {
-			return
+
+	bs = PBytes.Get(read_size, read_size)
+	n, err = syscall.Read(self.fd, bs)
+	switch {
+	case nil != err:
+		switch err {
+		case syscall.EAGAIN:
+		case syscall.EINTR:
+			err = nil
+		default:
+			self.fail(CloseType_error, 0, err)
 		}
-		self.payloadOffset += uint32(n)
-		if self.payloadOffset == uint32(bs[0]) {
-			// extLen + mask
-			if self.payloadLength == 126 {
-				self.payloadLength = (uint32(bs[2]) << 8) | uint32(bs[3])
-			}
-			if self.header&header_mask != 0 {
-				copy(bs[:4], bs[self.payloadOffset-4:])
-			}
-		} else {
-			return
+	case n == 0:
+		// 对端关闭了连接
+		err = self.fail(CloseType_error, 0, io.EOF)
+	default:
+		if self.discard {
+			// 丢弃读到的数据，直到对端关闭或 close_timeout
+		} else if err = self.feed(bs[:n]); nil != err && !self.Closed() && atomic.LoadUint32(&self.closing) != 0 {
+			// 协议错误或收到关闭帧之后，解析的状态不再可用，但仍需读取以等待对端关闭，
+			// 否则未读的数据会导致 RST，对端可能收不到关闭帧
+			self.discard = true
+			err = nil
 		}
 	}
-	self.header |= header_read
-	self.payloadOffset = 0
+	PBytes.Put(bs)
 
-	switch self.opCode {
-	case 0x9:
-		// ping，返回 pong
-		self.active = timer.Now()
-		self.flags |= flag_discard
-		self.Write(frame_pong)
-	case 0xA:
-		// pong，丢弃后续数据
-		self.active = timer.Now()
-		self.flags |= flag_discard
-	}
-	if self.payloadLength == 0 {
-		// 没有数据，当前帧结束
-		self.header = 0
-		goto __retry
-	}
-	if self.flags&flag_all != 0 {
-		// 跨帧数据
-		self.length += self.payloadLength
-		if self.offset == 0 {
-			// 待读取的缓冲
-			self.readBuf = PBytes.Get(int(self.length), int(self.length))
-		} else {
-			bs = self.readBuf
-			self.readBuf = PBytes.Get(int(self.length), int(self.length))
-			copy(self.readBuf[self.offset:], bs)
-			PBytes.Put(bs)
+	if nil == err && !self.Closed() {
+		// 没有出错，继续读取
+		atomic.StoreUint32(&self.reading, 0)
+		if !self.Closed() {
+			self.party.poollRead.Put(self)
 		}
+		return
 	}
-	return
-}
 
-func (self *chum) readAction() (err error) {
-	// if self.flags&flag_action != 0 {
-	// 	return
-	// }
-	bs := self.mask[4:5]
-__retry:
-	_, err = self.Read(bs)
-	if nil != err {
-		return
+__end:
+	atomic.StoreUint32(&self.reading, 0)
+	if self.Closed() && atomic.CompareAndSwapUint32(&self.reading, 0, 1) {
+		// 关闭时正在读，由读线程释放
+		self.releaseRead()
 	}
-	bs[0] ^= self.mask[self.payloadOffset&3]
-	self.payloadOffset++
-	self.action |= uint32(bs[0]&0x7F) << uint32(self.offset*7)
-	if bs[0]&0x80 != 0 {
-		// action 为多字节
-		if self.offset == 4 {
-			self.Close()
-			return Error_action
-		}
-		self.offset++
-		goto __retry
-	} else {
-		self.offset = 0
-		self.flags |= flag_action
-
-		// 根据 action type 确定是否读取后续数据
-		if router, ok := self.party.routers[self.action]; ok {
-			self.handler = router.Handler
-			switch router.Type {
-			case ActionType_vlen:
-			case ActionType_all:
-				self.flags |= flag_length | flag_all
-				self.length = self.payloadLength - self.payloadOffset
-				if self.length != 0 {
-					// 待读取的缓冲
-					self.readBuf = PBytes.Get(int(self.length), int(self.length))
-				} else {
-					self.flags |= flag_data | flag_discard
-
-					// 更新活跃时间（有效的通信才是活跃的）
-					self.active = timer.Now()
-					self.handler(self)
-				}
-			case ActionType_stream:
-				self.flags |= flag_length | flag_stream
-				// 待读取的缓冲
-				self.readBuf = PBytes.Get(1024, 1024)
-			default:
-				self.flags |= flag_data | flag_discard
+}
 
-				// 更新活跃时间（有效的通信才是活跃的）
-				self.active = timer.Now()
-				self.handler(self)
-			}
-		} else {
-			self.Close()
-			return Error_action_notfound
+// 解析读到的数据（可以是任意的片段）
+func (self *chum) feed(b []byte) (err error) {
+	var n, ev int
+	for !self.Closed() {
+		if n, ev, err = self.frame.Decode(b); nil != err {
+			return self.fail(CloseType_protocol, closeCode(err), err)
+		}
+		b = b[n:]
+		switch ev {
+		case wire.Event_more:
+			return
+		case wire.Event_header:
+			err = self.readHeader()
+		case wire.Event_payload:
+			err = self.readPayload()
+		}
+		if nil != err {
+			return
 		}
 	}
-	return
+	return Error_closed
 }
 
-func (self *chum) readLength() (err error) {
-	// if self.flags&flag_length != 0 {
-	// 	return
-	// }
-	bs := self.mask[4:5]
-__retry:
-	_, err = self.Read(bs)
-	if nil != err {
+func (self *chum) readHeader() (err error) {
+	h := self.frame.Header()
+	if h.OpCode&0x8 != 0 {
+		// 控制帧由 readControl 处理，不影响正在组装的数据消息
+		self.ctrlBuf = PBytes.Get(0, int(h.Length))
 		return
 	}
-	bs[0] ^= self.mask[self.payloadOffset&3]
-	self.payloadOffset++
-	self.length |= uint32(bs[0]&0x7F) << uint32(self.offset*7)
-	if bs[0]&0x80 != 0 {
-		// length 为多字节
-		if self.offset == 2 {
-			self.Close()
-			return Error_length
-		}
-		self.offset++
-		goto __retry
-	} else {
-		if self.length > self.payloadLength-self.payloadOffset && self.header&header_fin != 0 {
-			self.Close()
-			return Error_notenough
+	if h.OpCode != 0 {
+		// 新的消息
+		self.resetMessage()
+		self.message.Reset()
+		self.size = 0
+		if h.OpCode == 0x1 && self.party.validateUTF8 {
+			self.utf8 = utf8_accept
+		} else {
+			self.utf8 = utf8_none
 		}
-		self.offset = 0
-		self.flags |= flag_length
-		if self.length != 0 {
-			// 待读取的缓冲
-			self.readBuf = PBytes.Get(int(self.length), int(self.length))
+		if nil != self.deflate {
+			self.deflate.reset()
+			self.deflate.compressed = h.Rsv != 0
 		}
 	}
+	// 跨帧时为总长度
+	self.size += h.Length
+	if self.size > self.party.maxMessageSize {
+		return self.fail(CloseType_protocol, CloseCode_too_large, Error_too_large)
+	}
 	return
 }
 
-func (self *chum) readData() (err error) {
-	// if self.flags&flag_data != 0 {
-	// 	return
-	// }
-	if self.flags&flag_length == 0 {
-		if nil != self.readLength() {
-			return
+func (self *chum) readPayload() (err error) {
+	p := self.frame.Payload()
+	if self.frame.Header().OpCode&0x8 != 0 {
+		self.ctrlBuf = append(self.ctrlBuf, p...)
+		if self.frame.End() {
+			return self.readControl()
 		}
+		return
 	}
-	var n int
-	n, err = self.Read(self.readBuf[self.offset:])
-	if nil != err {
+	if atomic.LoadUint32(&self.closing) != 0 {
+		// 已发送关闭帧，不再处理数据消息，只等待对端的关闭帧
 		return
 	}
-	for n > 0 {
-		n--
-		self.readBuf[self.offset] ^= self.mask[self.payloadOffset&3]
-		self.offset++
-		self.payloadOffset++
+	if d := self.deflate; nil != d && d.compressed {
+		return self.readDeflate(p, self.frame.Final())
 	}
-	if self.flags&flag_stream != 0 {
-		// 更新活跃时间（有效的通信才是活跃的）
-		self.active = timer.Now()
-		self.handler(self)
-		// 因为是渐进流，所以重置偏移，以待下次缓冲
-		self.offset = 0
-		self.flags |= flag_again
-	} else if self.offset == self.length && self.header&header_fin != 0 {
-		self.offset = 0
-		self.flags |= flag_data | flag_discard
-
-		// 更新活跃时间（有效的通信才是活跃的）
-		self.active = timer.Now()
-		self.handler(self)
+	return self.readMessage(p, self.frame.Final())
+}
+
+// 处理控制帧（close、ping、pong）。控制帧可能夹在分片的数据帧之间，
+// 所以只使用 ctrlBuf，不修改数据消息的状态
+func (self *chum) readControl() (err error) {
+	switch self.frame.Header().OpCode {
+	case 0x8:
+		err = self.readClose()
+	case 0x9:
+		// ping，返回带相同数据的 pong
+		var bs [127]byte
+		bs[0] = 0x8A
+		bs[1] = byte(len(self.ctrlBuf))
+		n := copy(bs[2:], self.ctrlBuf)
+		self.Write(bs[:2+n])
+	}
+	self.active = timer.Now()
+	if nil != self.ctrlBuf {
+		PBytes.Put(self.ctrlBuf)
+		self.ctrlBuf = nil
 	}
 	return
 }
 
-func (self *chum) readLoop() {
-	// 同一时刻，只有一个线程可以读
-	if !atomic.CompareAndSwapUint32(&self.reading, 0, 1) {
-		if party := self.party; nil != party {
-			party.poollRead.Put(self)
-		}
+// 按 action 协议解析消息的数据，final 为 true 表示 b 是消息最后的数据
+// 分配 vlen 的缓冲之前检查声明的长度，防止很短的帧导致大量的分配。
+// b 为当前帧中 length 之后已读到的数据
+func (self *chum) checkLength(b []byte) error {
+	length := uint64(self.length)
+	if length > self.party.maxMessageSize {
+		return Error_too_large
+	}
+	if d := self.deflate; nil != d && d.compressed {
+		// 解压后的长度无法预知
+		return nil
+	}
+	if self.frame.Header().Fin && length > uint64(len(b))+self.frame.Remaining() {
+		// 最后一帧剩余的数据不够
+		return Error_notenough
+	}
+	return nil
+}
+
+func (self *chum) readMessage(b []byte, final bool) (err error) {
+	if err = self.validate(b, final); nil != err {
 		return
 	}
+	var n, ev int
+	for !self.Closed() {
+		if n, ev, err = self.message.Decode(b, final); nil != err {
+			return self.fail(CloseType_protocol, closeCode(err), err)
+		}
+		b = b[n:]
+		switch ev {
+		case wire.Event_more:
+			return
+		case wire.Event_action:
+			self.action = self.message.Action()
+			switch self.message.Type() {
+			case ActionType_vlen, ActionType_all:
+			case ActionType_stream:
+				self.flags |= flag_stream
+			default:
+				self.flags |= flag_received
+				err = self.dispatch()
+			}
+		case wire.Event_length:
+			self.length = self.message.Length()
+			if err = self.checkLength(b); nil != err {
+				return self.fail(CloseType_protocol, closeCode(err), err)
+			}
+			self.readBuf = PBytes.Get(int(self.length), int(self.length))
+		case wire.Event_data:
+			data := self.message.Data()
+			if self.flags&flag_stream != 0 {
+				// 渐进流，每次读到的数据都交给 handler
+				self.chunk = data
+				self.length = uint32(len(data))
+				if self.message.Last() {
+					self.flags |= flag_received
+				}
+				err = self.dispatch()
+				self.flags |= flag_again
+			} else if self.message.Type() == ActionType_vlen {
+				self.offset += uint32(copy(self.readBuf[self.offset:], data))
+			} else {
+				self.append(data)
+			}
+		case wire.Event_end:
+			if self.flags&flag_received == 0 {
+				// stream 以空帧结束时没有数据
+				self.chunk = nil
+				self.flags |= flag_received
+				err = self.dispatch()
+			}
+			self.resetMessage()
+		}
+		if nil != err {
+			return
+		}
+	}
+	return Error_closed
+}
 
-	if self.header&header_read == 0 {
-		if nil != self.readHeader() {
-			goto __end
+// ActionType_all 的数据跨帧时追加到 readBuf
+func (self *chum) append(data []byte) {
+	l := int(self.length) + len(data)
+	if l > cap(self.readBuf) {
+		buf := self.readBuf
+		// 按已知的消息长度分配，减少复制
+		c := int(self.size)
+		if c < l {
+			c = l
+		}
+		self.readBuf = PBytes.Get(int(self.length), c)
+		if nil != buf {
+			copy(self.readBuf, buf[:self.length])
+			PBytes.Put(buf)
 		}
 	}
-	if self.flags&flag_action == 0 {
-		if nil != self.readAction() {
-			goto __end
+	self.readBuf = append(self.readBuf[:self.length], data...)
+	self.length = uint32(l)
+}
+
+func (self *chum) lookup(action uint32) (int32, bool) {
+	party := self.party
+	table := party.table()
+	router, ok := table.routers[action]
+	if !ok {
+		switch {
+		case action == party.rpcReply:
+			// RPC 的回复
+			router, ok = Router{Type: ActionType_all, handler: readReply}, true
+		case nil != party.named && action == party.named.Action:
+			// 查询命名 action 的映射
+			router, ok = Router{Type: ActionType_discard, handler: sendNames}, true
 		}
 	}
-	if self.flags&flag_action != 0 {
-		if self.flags&flag_data == 0 {
-			if nil != self.readData() {
-				goto __end
+	if !ok {
+		if nil != table.defaultRouter {
+			router, ok = *table.defaultRouter, true
+		} else {
+			switch party.unknownAction {
+			case UnknownAction_discard:
+				router, ok = Router{Type: ActionType_discard}, true
+			case UnknownAction_reply:
+				router, ok = Router{Type: ActionType_discard, handler: replyUnknown}, true
 			}
 		}
 	}
+	self.handler = router.handler
+	return router.Type, ok
+}
 
-	if self.flags&flag_discard != 0 {
-		// 无效数据，需要丢弃
-		if self.payloadOffset < self.payloadLength {
-			n, err := io.CopyN(ioutil.Discard, self, int64(self.payloadLength-self.payloadOffset))
-			if nil != err {
-				goto __end
-			}
-			self.payloadOffset += uint32(n)
-		}
+func (self *chum) dispatch() (err error) {
+	// 更新活跃时间（有效的通信才是活跃的）
+	self.active = timer.Now()
+	if err = self.call(); nil != err {
+		// 只关闭出错的连接
+		return self.fail(CloseType_panic, CloseCode_internal, err)
 	}
+	return
+}
 
-	if self.payloadOffset == self.payloadLength {
-		// 读取完毕，重置 header
-		if self.header&header_fin != 0 {
-			self.flags = 0
-			self.offset = 0
-			self.length = 0
-			self.action = 0
-			self.handler = nil
-			if nil != self.readBuf {
-				PBytes.Put(self.readBuf)
-				self.readBuf = nil
-			}
+// 调用 handler，panic 时返回 *PanicError
+func (self *chum) call() (err error) {
+	if nil == self.handler {
+		return
+	}
+	defer func() {
+		if v := recover(); nil != v {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
 		}
-		self.header = 0
-		self.payloadOffset = 0
-		self.payloadLength = 0
-		atomic.StoreUint32(&self.reading, 0)
-		if party := self.party; nil != party {
-			party.poollRead.Put(self)
+	}()
+	self.handler(self)
+	return
+}
+
+// 调用应用的回调（OnError、OnClose 等），panic 时交给 pooll.DefaultPanicHandler 并返回 *PanicError，
+// 以免连接停留在中间状态
+func guard(name string, f func()) (err error) {
+	defer func() {
+		if v := recover(); nil != v {
+			e := &PanicError{Value: v, Stack: debug.Stack()}
+			pooll.DefaultPanicHandler(name, e.Value, e.Stack)
+			err = e
 		}
-		return
+	}()
+	f()
+	return
+}
+
+// 回复 Config.UnknownReply，数据为未知的 action
+func replyUnknown(c Chum) {
+	self := c.(*chum)
+	var bs [wire.MaxActionBytes << 1]byte
+	b := wire.AppendAction(bs[:0], self.party.unknownReply)
+	b = wire.AppendAction(b, self.action)
+	self.WriteFrame(b, false)
+}
+
+// 消息处理完毕，重置应用数据的状态
+func (self *chum) resetMessage() {
+	self.flags = 0
+	self.offset = 0
+	self.length = 0
+	self.action = 0
+	self.handler = nil
+	self.chunk = nil
+	if nil != self.readBuf {
+		PBytes.Put(self.readBuf)
+		self.readBuf = nil
 	}
+}
 
-__end:
-	atomic.StoreUint32(&self.reading, 0)
+// 释放读相关的资源，只能由持有 reading 的线程调用
+func (self *chum) releaseRead() {
+	if nil != self.handler && self.flags&flag_stream != 0 && self.flags&flag_received == 0 {
+		// 通知未结束的 stream 连接已关闭
+		self.chunk = nil
+		if err := self.call(); nil != err && nil != self.party.onError {
+			guard("OnError", func() {
+				self.party.onError(self, err)
+			})
+		}
+	}
+	self.resetMessage()
+	self.message.Reset()
+	self.frame.Reset()
+	if nil != self.ctrlBuf {
+		PBytes.Put(self.ctrlBuf)
+		self.ctrlBuf = nil
+	}
+	if nil != self.deflate {
+		self.deflate.reset()
+	}
 }
@@ -0,0 +1,439 @@
+// client 是 bbq 服务端的 Go 客户端，使用相同的 action 协议：
+// 每条消息以 7 位 varint 编码的 action（最多 5 字节）开头，
+// vlen 类型的 action 之后是 varint 编码的长度（最多 3 字节）及数据。
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/gobwas/pool/pbytes"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/ikCourage/autumn/bbq/wire"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ActionType_discard = wire.ActionType_discard
+	ActionType_vlen    = wire.ActionType_vlen
+	ActionType_stream  = wire.ActionType_stream
+	ActionType_all     = wire.ActionType_all
+)
+
+const (
+	// 默认的最大消息长度
+	max_message_size = 1 << 22
+	// 发送关闭帧后，等待对端回应的最长时间
+	close_timeout = time.Second
+)
+
+var (
+	Error_closed    = fmt.Errorf("the client is closed")
+	Error_dialed    = fmt.Errorf("the client is already dialed")
+	Error_action    = wire.Error_action
+	Error_length    = wire.Error_length
+	Error_notenough = wire.Error_notenough
+	Error_too_large = wire.Error_too_large
+)
+
+// 服务端推送消息的处理。Type 只支持 ActionType_discard、ActionType_vlen、
+// ActionType_all（推送按整条消息读取，ActionType_stream 按 ActionType_all 处理）
+type Router struct {
+	Type   int32
+	Action uint32
+	// 开启 Config.Named 时，使用服务端为该名称分配的 id（忽略 Action）
+	Name    string
+	Handler func(client Client, data []byte)
+}
+
+type Client interface {
+	// Dial 连接服务端，之后在单独的线程中读取推送的消息，
+	// handler 在该线程中顺序调用，不要在其中阻塞
+	Dial(ctx context.Context, urlstr string) error
+	AddRouters(routers ...Router)
+	// ActionId 返回服务端为命名 action 分配的 id（开启 Config.Named 时）
+	ActionId(name string) (uint32, bool)
+
+	// Send 发送 action 及之后的所有数据（对应 ActionType_all 或 ActionType_discard）
+	Send(action uint32, b []byte) error
+	// SendVlen 发送 action、长度及数据（对应 ActionType_vlen）
+	SendVlen(action uint32, b []byte) error
+	// Stream 开始一条分片的消息（对应 ActionType_stream），每次 Write 发送一帧，
+	// Close 时结束该消息。结束之前，其它的 Send 会等待
+	Stream(action uint32) (io.WriteCloser, error)
+
+	// Call 调用服务端的 RPC（服务端的 bbq.RPC），callback 在收到回复、超时或连接关闭时调用
+	Call(action uint32, req []byte, timeout time.Duration, callback func(resp []byte, err error)) error
+	// Invoke 调用服务端的 RPC 并等待回复或 ctx 结束
+	Invoke(ctx context.Context, action uint32, req []byte) ([]byte, error)
+
+	// Close 发送关闭帧，等待服务端回应后关闭连接
+	Close() error
+	CloseWithCode(code int, reason string) error
+	Closed() bool
+}
+
+type Config struct {
+	Dialer *ws.Dialer
+	// 服务端推送的单条消息的最大长度，超出则关闭连接
+	MaxMessageSize int64
+	// 收到没有注册的 action 时调用，nil 则忽略该消息
+	OnUnknown func(client Client, action uint32, data []byte)
+	// 连接关闭后调用，err 为关闭的原因（服务端发送关闭帧时为 wsutil.ClosedError）
+	OnClose func(client Client, err error)
+	// 开启命名的 action（服务端需配置 NamedActions），Dial 时查询映射，收到后才返回
+	Named bool
+	// 查询映射的保留 action，与服务端的 NamedActions.Action 相同，0 为默认值
+	NamedAction uint32
+	// RPC 回复使用的 action，与服务端的 RPCReply 相同，0 为默认值
+	RPCReply uint32
+}
+
+var (
+	defaultConfig = &Config{
+		MaxMessageSize: max_message_size,
+	}
+)
+
+type client struct {
+	conn    net.Conn
+	reader  io.Reader
+	dialer  ws.Dialer
+	state   uint32     // 0 未连接，1 已连接，2 已关闭
+	closing uint32     // 已发送关闭帧
+	msgLK   sync.Mutex // 数据消息不能交错发送
+	writeLK sync.Mutex // 控制帧可以插在分片的消息之间
+
+	routersLK  sync.RWMutex
+	routers    map[uint32]Router
+	decoder    wire.ActionDecoder
+	router     Router            // 当前消息的 router，没有注册时 Handler 为 nil
+	named      []Router          // 按名称注册的 router
+	names      map[string]uint32 // 服务端分配的 id
+	ready      chan struct{}     // 收到映射后关闭
+	readyOnce  sync.Once
+	nameAction uint32
+
+	calls    wire.Calls // 等待回复的 RPC
+	rpcReply uint32
+
+	maxMessageSize int64
+	onUnknown      func(client Client, action uint32, data []byte)
+	onClose        func(client Client, err error)
+}
+
+func New(config *Config) Client {
+	if nil == config {
+		config = defaultConfig
+	}
+	self := &client{
+		routers:        map[uint32]Router{},
+		maxMessageSize: config.MaxMessageSize,
+		onUnknown:      config.OnUnknown,
+		onClose:        config.OnClose,
+		rpcReply:       config.RPCReply,
+	}
+	self.decoder.Lookup = self.lookup
+	if self.rpcReply == 0 {
+		self.rpcReply = rpc_reply
+	}
+	self.routers[self.rpcReply] = Router{
+		Type:    ActionType_all,
+		Action:  self.rpcReply,
+		Handler: self.readReply,
+	}
+	if config.Named {
+		self.nameAction = config.NamedAction
+		if self.nameAction == 0 {
+			self.nameAction = names_action
+		}
+		self.ready = make(chan struct{})
+		self.routers[self.nameAction] = Router{
+			Type:    ActionType_all,
+			Action:  self.nameAction,
+			Handler: self.readNames,
+		}
+	}
+	if nil != config.Dialer {
+		self.dialer = *config.Dialer
+	}
+	if self.maxMessageSize <= 0 {
+		self.maxMessageSize = max_message_size
+	}
+	return self
+}
+
+func (self *client) Dial(ctx context.Context, urlstr string) error {
+	if atomic.LoadUint32(&self.state) != 0 {
+		return Error_dialed
+	}
+	conn, br, _, err := self.dialer.Dial(ctx, urlstr)
+	if nil != err {
+		return err
+	}
+	if !atomic.CompareAndSwapUint32(&self.state, 0, 1) {
+		conn.Close()
+		return Error_dialed
+	}
+	self.conn = conn
+	self.reader = conn
+	if nil != br {
+		// 握手时多读的数据
+		self.reader = io.MultiReader(br, conn)
+	}
+	go self.readLoop()
+	if nil != self.ready {
+		// 查询命名 action 的映射（服务端也可能已主动发送）
+		if err = self.Send(self.nameAction, nil); nil != err {
+			return err
+		}
+		select {
+		case <-self.ready:
+			if self.Closed() {
+				return Error_closed
+			}
+		case <-ctx.Done():
+			self.release(ctx.Err())
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (self *client) AddRouters(routers ...Router) {
+	self.routersLK.Lock()
+	for _, router := range routers {
+		if router.Name != "" && nil != self.ready {
+			self.named = append(self.named, router)
+			id, ok := self.names[router.Name]
+			if !ok {
+				// 收到映射后注册
+				continue
+			}
+			router.Action = id
+		}
+		self.routers[router.Action] = router
+	}
+	self.routersLK.Unlock()
+}
+
+func (self *client) Send(action uint32, b []byte) (err error) {
+	var bs [wire.MaxActionBytes]byte
+	prefix := wire.AppendAction(bs[:0], action)
+	self.msgLK.Lock()
+	err = self.writeFrame(0x82, prefix, b)
+	self.msgLK.Unlock()
+	return
+}
+
+func (self *client) SendVlen(action uint32, b []byte) (err error) {
+	var bs [wire.MaxActionBytes + wire.MaxLengthBytes]byte
+	prefix := wire.AppendAction(bs[:0], action)
+	if prefix, err = wire.AppendLength(prefix, len(b)); nil != err {
+		return
+	}
+	self.msgLK.Lock()
+	err = self.writeFrame(0x82, prefix, b)
+	self.msgLK.Unlock()
+	return
+}
+
+func (self *client) Stream(action uint32) (io.WriteCloser, error) {
+	if self.Closed() {
+		return nil, Error_closed
+	}
+	self.msgLK.Lock()
+	s := &stream{client: self}
+	s.prefix = wire.AppendAction(s.buf[:0], action)
+	return s, nil
+}
+
+func (self *client) Close() error {
+	return self.CloseWithCode(1000, "")
+}
+
+func (self *client) CloseWithCode(code int, reason string) (err error) {
+	if atomic.LoadUint32(&self.state) != 1 || !atomic.CompareAndSwapUint32(&self.closing, 0, 1) {
+		return Error_closed
+	}
+	var payload []byte
+	if code != 0 {
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+		payload = make([]byte, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		copy(payload[2:], reason)
+	}
+	err = self.writeFrame(0x88, nil, payload)
+	// 由 readLoop 收到回应（或超时）后关闭连接
+	self.conn.SetReadDeadline(time.Now().Add(close_timeout))
+	return
+}
+
+func (self *client) Closed() bool {
+	return atomic.LoadUint32(&self.state) == 2
+}
+
+// 写入一帧（客户端的帧必须有 mask），prefix 与 b 合并为一帧的数据
+func (self *client) writeFrame(b0 byte, prefix, b []byte) (err error) {
+	if atomic.LoadUint32(&self.state) != 1 {
+		return Error_closed
+	}
+	h := wire.Header{
+		Fin:    b0&0x80 != 0,
+		OpCode: b0 & 0x0F,
+		Masked: true,
+		Mask:   ws.NewMask(),
+		Length: uint64(len(prefix) + len(b)),
+	}
+	bs := wire.AppendHeader(pbytes.GetCap(wire.MaxHeaderSize+int(h.Length)), h)
+	n := len(bs)
+	bs = append(append(bs, prefix...), b...)
+	ws.Cipher(bs[n:], h.Mask, 0)
+	self.writeLK.Lock()
+	_, err = self.conn.Write(bs)
+	self.writeLK.Unlock()
+	pbytes.Put(bs)
+	if nil != err {
+		self.release(err)
+	}
+	return
+}
+
+func (self *client) readLoop() {
+	var err error
+	var hdr ws.Header
+	var bs []byte
+	rd := wsutil.Reader{
+		Source:         self.reader,
+		State:          ws.StateClientSide,
+		OnIntermediate: self.control,
+	}
+	for {
+		hdr, err = rd.NextFrame()
+		if nil != err {
+			break
+		}
+		if hdr.OpCode.IsControl() {
+			if err = self.control(hdr, &rd); nil != err {
+				break
+			}
+			continue
+		}
+		if hdr.Length > self.maxMessageSize {
+			err = Error_too_large
+			break
+		}
+		bs, err = ioutil.ReadAll(io.LimitReader(&rd, self.maxMessageSize+1))
+		if nil != err {
+			break
+		}
+		if int64(len(bs)) > self.maxMessageSize {
+			err = Error_too_large
+			break
+		}
+		if err = self.dispatch(bs); nil != err {
+			break
+		}
+	}
+	if ce, ok := err.(wsutil.ClosedError); ok {
+		// 服务端发起的关闭需要回应相同的状态码
+		if atomic.CompareAndSwapUint32(&self.closing, 0, 1) {
+			var payload [2]byte
+			if ce.Code != ws.StatusNoStatusRcvd {
+				binary.BigEndian.PutUint16(payload[:], uint16(ce.Code))
+				self.writeFrame(0x88, nil, payload[:])
+			} else {
+				self.writeFrame(0x88, nil, nil)
+			}
+		}
+	}
+	self.release(err)
+}
+
+// 处理控制帧：回应 ping，收到关闭帧时返回 wsutil.ClosedError
+func (self *client) control(hdr ws.Header, r io.Reader) (err error) {
+	var bs []byte
+	if bs, err = ioutil.ReadAll(r); nil != err {
+		return
+	}
+	switch hdr.OpCode {
+	case ws.OpPing:
+		return self.writeFrame(0x8A, nil, bs)
+	case ws.OpClose:
+		ce := wsutil.ClosedError{Code: ws.StatusNoStatusRcvd}
+		if len(bs) >= 2 {
+			ce.Code = ws.StatusCode(binary.BigEndian.Uint16(bs))
+			ce.Reason = string(bs[2:])
+		}
+		return ce
+	}
+	return
+}
+
+// 解析 action 并调用对应的 handler，bs 为完整的消息
+func (self *client) dispatch(bs []byte) (err error) {
+	var n, ev int
+	var data []byte
+	for {
+		if n, ev, err = self.decoder.Decode(bs, true); nil != err {
+			return
+		}
+		bs = bs[n:]
+		switch ev {
+		case wire.Event_more:
+			return
+		case wire.Event_data:
+			data = self.decoder.Data()
+		case wire.Event_end:
+			if nil != self.router.Handler {
+				self.router.Handler(self, data)
+			} else if nil != self.onUnknown {
+				self.onUnknown(self, self.decoder.Action(), data)
+			}
+		}
+	}
+}
+
+func (self *client) lookup(action uint32) (int32, bool) {
+	self.routersLK.RLock()
+	router, ok := self.routers[action]
+	self.routersLK.RUnlock()
+	if !ok {
+		// 没有注册的 action 读取所有的数据，交给 OnUnknown
+		router.Type = ActionType_all
+	}
+	self.router = router
+	return router.Type, true
+}
+
+func (self *client) release(err error) {
+	for {
+		state := atomic.LoadUint32(&self.state)
+		if state == 2 {
+			return
+		}
+		if atomic.CompareAndSwapUint32(&self.state, state, 2) {
+			break
+		}
+	}
+	self.conn.Close()
+	// 在其它线程回调，因为关闭时可能持有 msgLK
+	self.calls.Close(Error_closed)
+	if nil != self.ready {
+		// Dial 不再等待映射
+		self.readyOnce.Do(func() {
+			close(self.ready)
+		})
+	}
+	if nil != self.onClose {
+		self.onClose(self, err)
+	}
+}
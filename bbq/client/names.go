@@ -0,0 +1,53 @@
+package client
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// 与服务端的 names_action 相同
+	names_action = 0xFFFFFFFF
+)
+
+// 收到服务端的映射，之后按名称注册的 router 使用分配的 id
+func (self *client) readNames(c Client, b []byte) {
+	names := map[string]uint32{}
+	for len(b) > 0 {
+		l, n := binary.Uvarint(b)
+		if n <= 0 || l > uint64(len(b)-n) {
+			return
+		}
+		name := string(b[n : n+int(l)])
+		b = b[n+int(l):]
+		id, n := binary.Uvarint(b)
+		if n <= 0 || id > 0xFFFFFFFF {
+			return
+		}
+		b = b[n:]
+		names[name] = uint32(id)
+	}
+	self.routersLK.Lock()
+	for name, id := range self.names {
+		if router, ok := self.routers[id]; ok && router.Name == name {
+			delete(self.routers, id)
+		}
+	}
+	self.names = names
+	for _, router := range self.named {
+		if id, ok := names[router.Name]; ok {
+			router.Action = id
+			self.routers[id] = router
+		}
+	}
+	self.routersLK.Unlock()
+	self.readyOnce.Do(func() {
+		close(self.ready)
+	})
+}
+
+func (self *client) ActionId(name string) (id uint32, ok bool) {
+	self.routersLK.RLock()
+	id, ok = self.names[name]
+	self.routersLK.RUnlock()
+	return
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"github.com/ikCourage/autumn/bbq/wire"
+	"time"
+)
+
+const (
+	// 与服务端的 rpc_reply 相同
+	rpc_reply = wire.RPC_reply
+)
+
+var (
+	Error_timeout = wire.Error_timeout
+)
+
+// 对端返回的错误
+type RPCError = wire.RPCError
+
+// RPC 返回处理服务端请求的 router，handler 返回的数据自动回复给服务端，
+// 返回 error 时回复错误信息。handler 在读线程中调用，不要在其中阻塞
+func RPC(action uint32, handler func(client Client, req []byte) (resp []byte, err error)) Router {
+	return Router{
+		Type:   ActionType_all,
+		Action: action,
+		Handler: func(c Client, b []byte) {
+			self := c.(*client)
+			id, req, err := wire.ReadRequest(b)
+			if nil != err {
+				return
+			}
+			resp, err := handler(c, req)
+			self.reply(id, resp, err)
+		},
+	}
+}
+
+func (self *client) reply(id uint32, resp []byte, err error) error {
+	var bs [wire.MaxActionBytes*2 + 1]byte
+	status := byte(wire.RPC_ok)
+	if nil != err {
+		status = wire.RPC_error
+		resp = []byte(err.Error())
+	}
+	prefix := wire.AppendReply(bs[:0], self.rpcReply, id, status)
+	self.msgLK.Lock()
+	err = self.writeFrame(0x82, prefix, resp)
+	self.msgLK.Unlock()
+	return err
+}
+
+// 调用服务端的 RPC，收到回复、超时或连接关闭时回调 callback
+// （回复在读线程中回调，不要在其中阻塞），timeout 为 0 时不超时
+func (self *client) Call(action uint32, req []byte, timeout time.Duration, callback func(resp []byte, err error)) (err error) {
+	_, err = self.call(action, req, timeout, callback)
+	return
+}
+
+// 调用服务端的 RPC 并等待回复，不能在 handler 中调用（回复由读线程处理）
+func (self *client) Invoke(ctx context.Context, action uint32, req []byte) ([]byte, error) {
+	var resp []byte
+	var err error
+	done := make(chan struct{})
+	id, e := self.call(action, req, 0, func(b []byte, e error) {
+		resp, err = b, e
+		close(done)
+	})
+	if nil != e {
+		return nil, e
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if nil != self.calls.Take(id) {
+			return nil, ctx.Err()
+		}
+		// 已经在回调
+		<-done
+	}
+	return resp, err
+}
+
+func (self *client) call(action uint32, req []byte, timeout time.Duration, callback func(resp []byte, err error)) (id uint32, err error) {
+	var bs [wire.MaxActionBytes * 2]byte
+	id, ok := self.calls.Add(callback)
+	if !ok {
+		return 0, Error_closed
+	}
+	prefix := wire.AppendRequest(bs[:0], action, id)
+	self.msgLK.Lock()
+	err = self.writeFrame(0x82, prefix, req)
+	self.msgLK.Unlock()
+	if nil != err {
+		self.calls.Take(id)
+		return
+	}
+	self.calls.Expire(id, timeout)
+	return
+}
+
+// 收到服务端的回复
+func (self *client) readReply(c Client, b []byte) {
+	self.calls.Reply(b)
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"github.com/ikCourage/autumn/bbq/wire"
+	"sync/atomic"
+)
+
+// 分片发送的消息：第一帧带 action（fin 为 0），之后为 continuation 帧，
+// Close 时发送 fin 帧结束消息。服务端 ActionType_stream 的 handler 每帧调用一次
+type stream struct {
+	client *client
+	buf    [wire.MaxActionBytes]byte
+	prefix []byte // action 的编码，发送第一帧后为 nil
+	closed uint32
+}
+
+func (self *stream) Write(b []byte) (n int, err error) {
+	if atomic.LoadUint32(&self.closed) != 0 {
+		return 0, Error_closed
+	}
+	if len(b) == 0 {
+		return
+	}
+	if nil != self.prefix {
+		err = self.client.writeFrame(0x02, self.prefix, b)
+		self.prefix = nil
+	} else {
+		err = self.client.writeFrame(0x00, nil, b)
+	}
+	if nil == err {
+		n = len(b)
+	}
+	return
+}
+
+func (self *stream) Close() (err error) {
+	if !atomic.CompareAndSwapUint32(&self.closed, 0, 1) {
+		return Error_closed
+	}
+	if nil != self.prefix {
+		// 没有数据，只发送 action
+		err = self.client.writeFrame(0x82, self.prefix, nil)
+	} else {
+		err = self.client.writeFrame(0x80, nil, nil)
+	}
+	self.client.msgLK.Unlock()
+	return
+}
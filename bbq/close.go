@@ -0,0 +1,169 @@
+package bbq
+
+import (
+	"encoding/binary"
+	"github.com/ikCourage/autumn/timer"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// RFC 6455 7.4.1
+const (
+	CloseCode_normal      = 1000
+	CloseCode_away        = 1001
+	CloseCode_protocol    = 1002
+	CloseCode_unsupported = 1003
+	CloseCode_nostatus    = 1005
+	CloseCode_invalid     = 1007
+	CloseCode_policy      = 1008
+	CloseCode_too_large   = 1009
+	CloseCode_internal    = 1011
+)
+
+const (
+	// 发送关闭帧后，等待待写数据写完及对端回应关闭帧的最长时间
+	close_timeout = time.Second
+)
+
+// chum.closing 的状态
+const (
+	// 已发送关闭帧，等待对端回应
+	closing_sent = 1
+	// 双方都已发送关闭帧，待写数据写完后关闭
+	closing_done = 2
+)
+
+// code 为 0 时，关闭帧不带数据
+func closeFrame(code int, text string) []byte {
+	if code == 0 {
+		return []byte{0x88, 0}
+	}
+	if len(text) > 123 {
+		text = text[:123]
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+	bs := make([]byte, 4+len(text))
+	bs[0] = 0x88
+	bs[1] = byte(2 + len(text))
+	binary.BigEndian.PutUint16(bs[2:], uint16(code))
+	copy(bs[4:], text)
+	return bs
+}
+
+// 检查调用者给出的关闭码和原因，code 为 0 时发送不带关闭码的关闭帧
+func checkClose(code int, reason string) error {
+	if code != 0 && !validCloseCode(code) {
+		return Error_close_code
+	}
+	if !utf8.ValidString(reason) {
+		return Error_utf8
+	}
+	return nil
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+	case code >= 1007 && code <= 1011:
+	case code >= 3000 && code <= 4999:
+	default:
+		return false
+	}
+	return true
+}
+
+// 发送关闭帧，之后不再写入其它数据。reason.Type 为 CloseType_peer 时是回应对端的关闭帧，
+// 握手已完成，否则需等待对端回应。返回 true 表示可以立即关闭（握手已完成且没有待写的数据，或者无法写入）。
+// locked 为 true 时（持有 chumsLK），不能等待 writeLK
+func (self *chum) sendClose(locked bool, code int, text string, reason CloseReason) (done bool) {
+	peer := reason.Type == CloseType_peer
+	if locked {
+		// 防止与 Write -> close 的加锁顺序相反而死锁
+		if !self.writeLK.TryLock() {
+			return true
+		}
+	} else {
+		self.writeLK.Lock()
+	}
+	if self.closing != 0 {
+		if peer {
+			// 已发送过关闭帧，对端的关闭帧即为回应
+			atomic.StoreUint32(&self.closing, closing_done)
+			done = len(self.writeQueue) == 0
+		}
+		self.writeLK.Unlock()
+		return
+	}
+	self.closeReason = reason
+	if peer {
+		atomic.StoreUint32(&self.closing, closing_done)
+	} else {
+		atomic.StoreUint32(&self.closing, closing_sent)
+	}
+	if nil != self.writeCond {
+		// 唤醒 SlowPolicy_block 时等待的写入
+		self.writeCond.Broadcast()
+	}
+	self.writeLocked(closeFrame(code, text))
+	done = peer && len(self.writeQueue) == 0
+	// 持有 chumsLK 时不能由 unlockWrite 关闭，写入出错时由调用者关闭
+	if nil != self.releaseWrite() {
+		done = true
+	}
+	return
+}
+
+// 发送关闭帧并关闭连接。由 writeLoop 写完待写数据、readClose 收到对端的回应后关闭，
+// 超过 close_timeout 则强制关闭
+func (self *chum) closeWithCode(locked bool, code int, text string, reason CloseReason) error {
+	if self.Closed() {
+		return Error_closed
+	}
+	if self.sendClose(locked, code, text, reason) {
+		return self.close(locked, reason)
+	}
+	timer.After(close_timeout, func() {
+		self.close(false, reason)
+	})
+	return nil
+}
+
+// 解析对端的关闭帧（已由 readControl 读入 ctrlBuf），回应后关闭连接。
+// 服务端已先发送了关闭帧时，这是对端的回应，不再回应
+func (self *chum) readClose() (err error) {
+	code := CloseCode_nostatus
+	reply := 0
+	text := ""
+	switch len(self.ctrlBuf) {
+	case 0:
+	case 1:
+		return self.fail(CloseType_protocol, CloseCode_protocol, Error_close_code)
+	default:
+		code = int(binary.BigEndian.Uint16(self.ctrlBuf))
+		if !validCloseCode(code) {
+			return self.fail(CloseType_protocol, CloseCode_protocol, Error_close_code)
+		}
+		if self.party.validateUTF8 && !utf8.Valid(self.ctrlBuf[2:]) {
+			return self.fail(CloseType_protocol, CloseCode_invalid, Error_utf8)
+		}
+		// 回应相同的状态码
+		reply = code
+		text = string(self.ctrlBuf[2:])
+	}
+	self.closeWithCode(false, reply, "", CloseReason{Type: CloseType_peer, Code: code, Reason: text})
+	return Error_closed
+}
+
+// 协议错误对应的状态码
+func closeCode(err error) int {
+	switch err {
+	case Error_too_large:
+		return CloseCode_too_large
+	case Error_action_notfound:
+		return CloseCode_policy
+	}
+	return CloseCode_protocol
+}
@@ -0,0 +1,101 @@
+// codec 是消息数据的编解码，服务端（bbq.Handle、bbq.WriteValue）及客户端通用。
+// 编码追加到调用者提供的 dst，以便直接写入池中的缓冲区
+package codec
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+type Codec interface {
+	// 追加 v 的编码，返回追加后的 dst
+	Append(dst []byte, v interface{}) ([]byte, error)
+	// 解码 b 到 v（指针），b 在返回后可能被复用，不能保留
+	Unmarshal(b []byte, v interface{}) error
+}
+
+var (
+	JSON   Codec = jsonCodec{}
+	Gob    Codec = gobCodec{}
+	Binary Codec = binaryCodec{}
+
+	Error_trailing = fmt.Errorf("trailing data after value")
+)
+
+// 把写入追加到切片
+type appender struct {
+	b []byte
+}
+
+func (self *appender) Write(p []byte) (int, error) {
+	self.b = append(self.b, p...)
+	return len(p), nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Append(dst []byte, v interface{}) ([]byte, error) {
+	w := appender{b: dst}
+	err := json.NewEncoder(&w).Encode(v)
+	if nil != err {
+		return dst, err
+	}
+	// 去掉 Encoder 追加的换行
+	return w.b[:len(w.b)-1], nil
+}
+
+func (jsonCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+// 每条消息都是独立的 gob 流（包含类型信息）
+type gobCodec struct{}
+
+func (gobCodec) Append(dst []byte, v interface{}) ([]byte, error) {
+	w := appender{b: dst}
+	if err := gob.NewEncoder(&w).Encode(v); nil != err {
+		return dst, err
+	}
+	return w.b, nil
+}
+
+func (gobCodec) Unmarshal(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+// 紧凑的二进制编码：实现了 encoding.BinaryMarshaler（BinaryUnmarshaler）的值使用其编码，
+// 否则为 encoding/binary 的小端定长编码（数字、bool 及其组成的数组、结构体）
+type binaryCodec struct{}
+
+func (binaryCodec) Append(dst []byte, v interface{}) ([]byte, error) {
+	if m, ok := v.(encoding.BinaryMarshaler); ok {
+		b, err := m.MarshalBinary()
+		if nil != err {
+			return dst, err
+		}
+		return append(dst, b...), nil
+	}
+	w := appender{b: dst}
+	if err := binary.Write(&w, binary.LittleEndian, v); nil != err {
+		return dst, err
+	}
+	return w.b, nil
+}
+
+func (binaryCodec) Unmarshal(b []byte, v interface{}) error {
+	if m, ok := v.(encoding.BinaryUnmarshaler); ok {
+		return m.UnmarshalBinary(b)
+	}
+	r := bytes.NewReader(b)
+	if err := binary.Read(r, binary.LittleEndian, v); nil != err {
+		return err
+	}
+	if r.Len() != 0 {
+		return Error_trailing
+	}
+	return nil
+}
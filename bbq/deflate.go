@@ -0,0 +1,331 @@
+package bbq
+
+import (
+	"compress/flate"
+	"fmt"
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws/wsflate"
+	"io"
+	"runtime/debug"
+	"sync"
+)
+
+// permessage-deflate（RFC 7692）。
+// 服务端总是声明 server_no_context_takeover，每条消息独立压缩，
+// 所以广播时只需压缩一次即可发给所有协商了压缩的连接
+type Compression struct {
+	// 要求客户端每条消息独立压缩（client_no_context_takeover），
+	// 否则每个连接需要额外保留 32KB 的解压窗口
+	ClientNoContextTakeover bool
+	// 要求客户端使用的窗口大小（client_max_window_bits，8~15），0 为不限制
+	ClientMaxWindowBits int
+	// 压缩级别（flate.BestSpeed ~ flate.BestCompression），0 为 flate.BestSpeed
+	Level int
+	// 小于该长度的消息不压缩，0 为 compress_threshold
+	Threshold int
+}
+
+const (
+	compress_threshold = 128
+	// 解压窗口的大小
+	deflate_window = 32768
+	// 每次解压交给 readMessage 的最大长度
+	inflate_size = 1 << 14
+)
+
+var (
+	// sync flush 的结尾，发送时去掉，接收时补上
+	deflate_tail = []byte{0x00, 0x00, 0xFF, 0xFF}
+
+	// 消息被放弃（连接关闭或开始了新的消息）
+	error_inflate_abort = fmt.Errorf("inflate aborted")
+)
+
+// 每个连接的解压状态
+type deflate struct {
+	takeover   bool   // 客户端保留上下文，需要使用上一条消息作为字典
+	compressed bool   // 当前消息是否被压缩
+	dict       []byte // 上下文（最近 32KB 的解压数据）
+	src        *inflateSource
+}
+
+// 当前消息压缩的数据
+type inflateSource struct {
+	b     []byte      // 当前帧未解压的数据
+	final bool        // 当前帧是最后一帧
+	tail  bool        // 已补上 deflate_tail
+	in    chan []byte // 跨帧时由读线程交给解压 goroutine 的下一帧，关闭表示放弃该消息
+	done  chan error  // 当前帧已用完（nil），或者解压出错
+}
+
+type compressor struct {
+	config  Compression
+	writers sync.Pool
+	readers sync.Pool
+}
+
+// 将数据追加到 PBytes 的缓冲
+type pbuffer struct {
+	b []byte
+}
+
+func (self *pbuffer) Write(b []byte) (int, error) {
+	l := len(self.b)
+	if l+len(b) > cap(self.b) {
+		buf := self.b
+		self.b = PBytes.Get(l, (l+len(b))<<1)
+		copy(self.b, buf)
+		PBytes.Put(buf)
+	}
+	self.b = append(self.b, b...)
+	return len(b), nil
+}
+
+func newCompressor(config *Compression) *compressor {
+	self := &compressor{
+		config: *config,
+	}
+	if self.config.Level == 0 || self.config.Level < flate.HuffmanOnly || self.config.Level > flate.BestCompression {
+		self.config.Level = flate.BestSpeed
+	}
+	if self.config.Threshold <= 0 {
+		self.config.Threshold = compress_threshold
+	}
+	if self.config.ClientMaxWindowBits < 8 || self.config.ClientMaxWindowBits > 15 {
+		self.config.ClientMaxWindowBits = 0
+	}
+	return self
+}
+
+// 协商 permessage-deflate，accepted 为 nil 表示没有接受
+func (self *compressor) negotiate(opt httphead.Option, accepted **wsflate.Parameters) (accept httphead.Option, err error) {
+	if nil != *accepted {
+		// 按照偏好顺序，只接受第一个
+		return
+	}
+	var offer wsflate.Parameters
+	if nil != offer.Parse(opt) {
+		return
+	}
+	if offer.ServerMaxWindowBits.Defined() && offer.ServerMaxWindowBits < 15 {
+		// compress/flate 总是使用 32KB 的窗口
+		return
+	}
+	params := &wsflate.Parameters{
+		ServerNoContextTakeover: true,
+		// 客户端主动声明时也接受，之后不需要保留解压窗口
+		ClientNoContextTakeover: self.config.ClientNoContextTakeover || offer.ClientNoContextTakeover,
+	}
+	if offer.ClientMaxWindowBits.Defined() && self.config.ClientMaxWindowBits != 0 {
+		// 只有客户端声明了 client_max_window_bits 才可以回应
+		params.ClientMaxWindowBits = wsflate.WindowBits(self.config.ClientMaxWindowBits)
+		if offer.ClientMaxWindowBits > 1 && offer.ClientMaxWindowBits < params.ClientMaxWindowBits {
+			params.ClientMaxWindowBits = offer.ClientMaxWindowBits
+		}
+	}
+	*accepted = params
+	return params.Option(), nil
+}
+
+// 压缩 b（不保留上下文），返回 PBytes 的缓冲，调用者需要 Put
+func (self *compressor) compress(b []byte) []byte {
+	buf := &pbuffer{b: PBytes.Get(0, len(b)>>1+16)}
+	w, _ := self.writers.Get().(*flate.Writer)
+	if nil == w {
+		w, _ = flate.NewWriter(buf, self.config.Level)
+	} else {
+		w.Reset(buf)
+	}
+	w.Write(b)
+	w.Flush()
+	self.writers.Put(w)
+	// 去掉 sync flush 的结尾
+	return buf.b[:len(buf.b)-len(deflate_tail)]
+}
+
+// 从池中取出解压器，以 dict 作为字典解压 src
+func (self *compressor) reader(src flate.Reader, dict []byte) io.ReadCloser {
+	r, _ := self.readers.Get().(io.ReadCloser)
+	if nil == r {
+		return flate.NewReaderDict(src, dict)
+	}
+	r.(flate.Resetter).Reset(src, dict)
+	return r
+}
+
+// 为发送构建帧，cbs 为压缩后的帧（不需要压缩时为 nil），均为 PBytes 的缓冲
+func (self *party) frames(b []byte, op byte) (bs, cbs []byte) {
+	var header [10]byte
+	n := frameHeader(header[:], op, len(b))
+	bs = PBytes.Get(n+len(b), n+len(b))
+	copy(bs, header[:n])
+	copy(bs[n:], b)
+	if nil != self.compressor && len(b) >= self.compressor.config.Threshold {
+		c := self.compressor.compress(b)
+		n = frameHeader(header[:], op|0x40, len(c))
+		cbs = PBytes.Get(n+len(c), n+len(c))
+		copy(cbs, header[:n])
+		copy(cbs[n:], c)
+		PBytes.Put(c)
+	}
+	return
+}
+
+// 压缩的消息边解压边交给 readMessage。compress/flate 在输入不足时无法恢复，
+// 所以跨帧的消息在单独的 goroutine 中解压，读线程每收到一帧交给它，并等待这一帧用完
+func (self *chum) readDeflate(p []byte, final bool) (err error) {
+	d := self.deflate
+	if nil == d.src {
+		d.src = &inflateSource{b: p, final: final}
+		if final {
+			// 只有一帧，直接在读线程解压
+			err = self.inflate(d.src)
+			d.src = nil
+			return
+		}
+		d.src.in = make(chan []byte)
+		d.src.done = make(chan error)
+		go self.inflateAsync(d.src)
+	} else {
+		d.src.final = final
+		d.src.in <- p
+	}
+	err = <-d.src.done
+	if final || nil != err {
+		d.src = nil
+	}
+	if e, ok := err.(*PanicError); ok {
+		return self.fail(CloseType_panic, CloseCode_internal, e)
+	}
+	return
+}
+
+func (self *chum) inflateAsync(src *inflateSource) {
+	defer func() {
+		if v := recover(); nil != v {
+			src.done <- &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	if err := self.inflate(src); err != error_inflate_abort {
+		src.done <- err
+	}
+}
+
+// 解压一条消息，每次解压出的数据都交给 readMessage
+func (self *chum) inflate(src *inflateSource) (err error) {
+	d := self.deflate
+	compressor := self.party.compressor
+	r := compressor.reader(src, d.dict)
+	defer compressor.readers.Put(r)
+	bs := PBytes.Get(inflate_size, inflate_size)
+	defer PBytes.Put(bs)
+
+	var n int
+	var size uint64
+	for {
+		n, err = r.Read(bs)
+		if n > 0 {
+			if size += uint64(n); size > self.party.maxMessageSize {
+				return self.fail(CloseType_protocol, CloseCode_too_large, Error_too_large)
+			}
+			if d.takeover {
+				d.keep(bs[:n])
+			}
+			if e := self.readMessage(bs[:n], false); nil != e {
+				return e
+			}
+		}
+		if nil != err {
+			break
+		}
+	}
+	switch err {
+	case io.EOF:
+		// 客户端发送了结束块，之后的数据（如果有）都丢弃
+		if err = src.drain(); nil != err {
+			return
+		}
+	case io.ErrUnexpectedEOF:
+		// 没有结束块，读完时为 io.ErrUnexpectedEOF
+	case error_inflate_abort:
+		return
+	default:
+		return self.fail(CloseType_protocol, CloseCode_invalid, err)
+	}
+	return self.readMessage(nil, true)
+}
+
+// 保留最近 32KB 作为下一条消息的字典。解压器初始化时已复制了字典，解压期间可以修改
+func (self *deflate) keep(b []byte) {
+	if len(b) >= deflate_window {
+		self.dict = append(self.dict[:0], b[len(b)-deflate_window:]...)
+		return
+	}
+	if over := len(self.dict) + len(b) - deflate_window; over > 0 {
+		self.dict = self.dict[:copy(self.dict, self.dict[over:])]
+	}
+	self.dict = append(self.dict, b...)
+}
+
+// 当前帧用完后向读线程要下一帧，最后一帧之后补上 deflate_tail
+func (self *inflateSource) next() error {
+	for len(self.b) == 0 {
+		switch {
+		case self.tail:
+			return io.EOF
+		case self.final:
+			self.b = deflate_tail
+			self.tail = true
+		default:
+			self.done <- nil
+			b, ok := <-self.in
+			if !ok {
+				return error_inflate_abort
+			}
+			self.b = b
+		}
+	}
+	return nil
+}
+
+func (self *inflateSource) Read(p []byte) (n int, err error) {
+	if err = self.next(); nil != err {
+		return
+	}
+	n = copy(p, self.b)
+	self.b = self.b[n:]
+	return
+}
+
+func (self *inflateSource) ReadByte() (c byte, err error) {
+	if err = self.next(); nil != err {
+		return
+	}
+	c = self.b[0]
+	self.b = self.b[1:]
+	return
+}
+
+// 丢弃剩余的数据直到消息结束
+func (self *inflateSource) drain() error {
+	for {
+		self.b = nil
+		if err := self.next(); nil != err {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (self *deflate) reset() {
+	if nil != self.src {
+		// 结束正在等待下一帧的 goroutine
+		if nil != self.src.in {
+			close(self.src.in)
+		}
+		self.src = nil
+	}
+	self.compressed = false
+}
@@ -0,0 +1,51 @@
+package bbq
+
+import (
+	"github.com/ikCourage/autumn/bbq/codec"
+	"github.com/ikCourage/autumn/bbq/wire"
+)
+
+// Handle 返回类型化的 RPC router（与 RPC 的协议相同）：请求用 c 解码为 *Req，
+// handler 返回的 *Resp 直接编码到池中的缓冲区回复，c 为 nil 时使用 codec.JSON。
+// 解码、编码失败及 handler 返回的 error 都回复为错误信息
+func Handle[Req, Resp any](action uint32, c codec.Codec, handler func(chum Chum, req *Req) (*Resp, error)) Router {
+	if nil == c {
+		c = codec.JSON
+	}
+	return Router{
+		Type:   ActionType_all,
+		Action: action,
+		Handler: func(ch Chum) {
+			self := ch.(*chum)
+			id, b, err := wire.ReadRequest(self.Data())
+			if nil != err {
+				self.fail(CloseType_protocol, CloseCode_protocol, err)
+				return
+			}
+			req := new(Req)
+			var resp *Resp
+			if err = c.Unmarshal(b, req); nil == err {
+				resp, err = handler(ch, req)
+			}
+			self.reply(id, func(dst []byte) ([]byte, error) {
+				if nil != err {
+					return dst, err
+				}
+				return c.Append(dst, resp)
+			})
+		},
+	}
+}
+
+// WriteValue 用 c 编码 v，作为 action 的消息（ActionType_all）发送，c 为 nil 时使用 codec.JSON
+func WriteValue(ch Chum, action uint32, c codec.Codec, v interface{}) (err error) {
+	if nil == c {
+		c = codec.JSON
+	}
+	b := wire.AppendAction(PBytes.Get(0, read_size), action)
+	if b, err = c.Append(b, v); nil == err {
+		_, err = ch.WriteFrame(b, false)
+	}
+	PBytes.Put(b)
+	return
+}
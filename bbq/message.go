@@ -0,0 +1,96 @@
+package bbq
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	Error_chum_notfound = fmt.Errorf("the connection is not found")
+	Error_team_notfound = fmt.Errorf("the team is not found")
+)
+
+// 以下方法不依赖 handler，可在任意线程（如 HTTP 接口、后台任务）中调用
+
+func (self *party) Chum(id string) Chum {
+	self.chumsLK.RLock()
+	chum, ok := self.chumsMap[id]
+	self.chumsLK.RUnlock()
+	if ok {
+		return chum
+	}
+	return nil
+}
+
+func (self *party) Team(id string) Team {
+	self.teamsLK.RLock()
+	team, ok := self.teams[id]
+	self.teamsLK.RUnlock()
+	if ok {
+		return team
+	}
+	return nil
+}
+
+func (self *party) SendTo(id string, b []byte, text bool) (err error) {
+	self.chumsLK.RLock()
+	chum, ok := self.chumsMap[id]
+	self.chumsLK.RUnlock()
+	if !ok {
+		return Error_chum_notfound
+	}
+	_, err = chum.WriteFrame(b, text)
+	return
+}
+
+func (self *party) BroadcastTeam(id string, b []byte, text bool, delay time.Duration, opts *BroadcastOptions) error {
+	self.teamsLK.RLock()
+	team, ok := self.teams[id]
+	self.teamsLK.RUnlock()
+	if !ok {
+		return Error_team_notfound
+	}
+	return team.broadcast(nil, b, text, delay, opts)
+}
+
+func (self *party) BroadcastAll(b []byte, text bool, opts *BroadcastOptions) error {
+	bs, cbs, err := self.broadcastFrames(b, text)
+	if nil != err {
+		return err
+	}
+	m := opts.matcher()
+	for _, chum := range self.snapshot() {
+		if m.match(nil, chum) {
+			chum.writeFailed(chum.writeFrames(bs, cbs))
+		}
+	}
+	putFrames(bs, cbs)
+	return nil
+}
+
+func (self *party) Kick(id string, code int, reason string) error {
+	if err := checkClose(code, reason); nil != err {
+		return err
+	}
+	self.chumsLK.RLock()
+	chum, ok := self.chumsMap[id]
+	self.chumsLK.RUnlock()
+	if !ok {
+		return Error_chum_notfound
+	}
+	return chum.closeWithCode(false, code, reason, CloseReason{Type: CloseType_kicked, Code: code, Reason: reason})
+}
+
+func (self *party) Count() int {
+	self.chumsLK.RLock()
+	n := len(self.chums)
+	self.chumsLK.RUnlock()
+	return n
+}
+
+func (self *party) TeamCount() int {
+	self.teamsLK.RLock()
+	n := len(self.teams)
+	self.teamsLK.RUnlock()
+	return n
+}
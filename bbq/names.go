@@ -0,0 +1,77 @@
+package bbq
+
+import (
+	"github.com/ikCourage/autumn/bbq/wire"
+	"sort"
+)
+
+// 命名的 action：Router.Name 不为空时由服务端分配 id（忽略 Router.Action），
+// 映射在连接建立时发送或由客户端通过保留的 action 查询，之后仍使用数值 id 通信。
+//
+// 映射的格式（ActionType_all）：保留的 action，之后每一项为 varint 长度、名称、varint id
+type NamedActions struct {
+	// 查询映射的保留 action，客户端发送该 action 时回复映射（使用相同的 action），
+	// 0 为 names_action
+	Action uint32
+	// 分配的 id 从 Base 开始（跳过已注册的 action），0 为 names_base
+	Base uint32
+	// 连接建立后立即发送映射
+	Push bool
+}
+
+const (
+	names_action = 0xFFFFFFFF
+	// 2 字节 varint 的最小值，数值 action 通常小于该值
+	names_base = 0x80
+)
+
+// 分配 id，同一名称总是使用相同的 id（即使已删除），调用者需持有 routersLK
+func (self *party) assign(table *routerTable, name string) uint32 {
+	if id, ok := self.names[name]; ok {
+		return id
+	}
+	for {
+		id := self.nextName
+		self.nextName++
+		if _, ok := table.routers[id]; ok || id == self.named.Action {
+			continue
+		}
+		self.names[name] = id
+		return id
+	}
+}
+
+// 编码当前已注册的命名 action
+func (self *party) manifest(table *routerTable) []byte {
+	routers := make([]Router, 0, len(self.names))
+	for _, v := range table.routers {
+		if v.Name != "" {
+			routers = append(routers, v)
+		}
+	}
+	sort.Slice(routers, func(i, j int) bool {
+		return routers[i].Action < routers[j].Action
+	})
+	b := wire.AppendAction(nil, self.named.Action)
+	for _, v := range routers {
+		b, _ = wire.AppendLength(b, len(v.Name))
+		b = append(b, v.Name...)
+		b = wire.AppendAction(b, v.Action)
+	}
+	return b
+}
+
+func (self *party) ActionId(name string) (uint32, bool) {
+	for _, v := range self.table().routers {
+		if v.Name == name {
+			return v.Action, true
+		}
+	}
+	return 0, false
+}
+
+// 回复映射
+func sendNames(c Chum) {
+	self := c.(*chum)
+	self.WriteFrame(self.party.table().names, false)
+}
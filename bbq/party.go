@@ -1,23 +1,69 @@
 package bbq
 
 import (
+	"context"
+	"fmt"
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
 	"github.com/ikCourage/autumn/kpoll"
 	"github.com/ikCourage/autumn/pooll"
 	"github.com/ikCourage/autumn/timer"
+	"io"
+	"math"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// TODO: 增加生命周期
+const (
+	// 以 1008 关闭连接
+	UnknownAction_close = iota
+	// 丢弃该消息，继续读取
+	UnknownAction_discard
+	// 丢弃该消息，并回复 Config.UnknownReply
+	UnknownAction_reply
+)
+
+// 待写的数据超出 Config.MaxPending 时的处理
+const (
+	// 以 1008 关闭连接
+	SlowPolicy_close = iota
+	// 丢弃新的消息，返回 Error_backlog
+	SlowPolicy_drop
+	// 丢弃队列中最早的可丢弃的消息（还未开始写的广播），仍不够时丢弃新的消息
+	SlowPolicy_drop_oldest
+	// 阻塞调用者直到有足够的空间，超过 Config.SlowTimeout 时丢弃新的消息。
+	// 只对 Write、WriteFrame 等直接的写入有效，广播的消息不会阻塞，按 SlowPolicy_drop 处理
+	SlowPolicy_block
+)
+
+const (
+	party_idle     = 0
+	party_running  = 1
+	party_shutdown = 2
+	party_closed   = 3
+
+	shutdown_interval = time.Millisecond * 10
+)
+
+var (
+	Error_party_running = fmt.Errorf("the party is already running")
+	Error_party_closed  = fmt.Errorf("the party is closed")
+)
+
 type party struct {
 	upgrader *ws.Upgrader
+	ln       net.Listener
+	skFd     int
+	state    uint32
 
-	kpoller    kpoll.Kpoll
-	poollWrite pooll.Pooll
-	poollRead  pooll.Pooll
-	poollTeam  pooll.Pooll
+	kpoller     kpoll.Kpoll
+	poollAccept pooll.Pooll
+	poollWrite  pooll.Pooll
+	poollRead   pooll.Pooll
+	poollTeam   pooll.Pooll
 
 	chumsLK  sync.RWMutex
 	chumsMap map[string]*chum
@@ -27,7 +73,30 @@ type party struct {
 	cursor   *chum
 	teamsLK  sync.RWMutex
 	teams    map[string]*team
-	routers  map[uint32]Router
+	// *routerTable，读取时不加锁，修改时复制后替换
+	routers       atomic.Value
+	routersLK     sync.Mutex
+	middlewares   []Middleware
+	named         *NamedActions
+	names         map[string]uint32
+	nextName      uint32
+	unknownAction int
+	unknownReply  uint32
+	rpcReply      uint32
+	maxPending    int
+	slowPolicy    int
+	slowTimeout   time.Duration
+
+	authorize    func(req *Request) (interface{}, error)
+	onConnect    func(chum Chum) error
+	onClose      func(chum Chum, reason CloseReason)
+	onError      func(chum Chum, err error)
+	closedEvents []closeEvent // 持锁期间关闭的连接，等待回调 onClose
+
+	maxMessageSize uint64
+	strict         bool
+	validateUTF8   bool
+	compressor     *compressor
 
 	frequently      int64
 	timeout         int64
@@ -35,23 +104,98 @@ type party struct {
 	clock           int64
 	sleep           *time.Timer
 	wakeup          chan struct{}
+	done            chan struct{}
 }
 
 type Party interface {
 	Listen(network, address string) error
+	// AddRouters、RemoveRouters 等可以在 Listen 之后随时调用，
+	// 正在读取的消息仍使用原来的 handler
 	AddRouters(routers ...Router)
+	RemoveRouters(actions ...uint32)
+	// Actions 返回已注册的 action（升序）
+	Actions() []uint32
+	// ActionId 返回命名 action 分配的 id
+	ActionId(name string) (uint32, bool)
+	// SetDefaultRouter 设置没有注册的 action 使用的 router（忽略 Action），
+	// 设置后 Config.UnknownAction 无效
+	SetDefaultRouter(router Router)
+	// Use 添加作用于所有 router 的中间件，先添加的在外层
+	Use(middlewares ...Middleware)
+
+	// 以下可在任意线程调用（不需要在 handler 中）
+	// Chum 返回 Register 了 id 的连接，没有时返回 nil
+	Chum(id string) Chum
+	// Team 返回 id 的 team，没有成员时返回 nil
+	Team(id string) Team
+	// SendTo 发送给 Register 了 id 的连接，b 为消息的数据（不含帧头）
+	SendTo(id string, b []byte, text bool) error
+	// BroadcastTeam 发送给 team 的成员，delay、opts 同 Chum.Broadcast
+	BroadcastTeam(id string, b []byte, text bool, delay time.Duration, opts *BroadcastOptions) error
+	// BroadcastAll 立刻发送给所有匹配 opts 的连接
+	BroadcastAll(b []byte, text bool, opts *BroadcastOptions) error
+	// Multicast 立刻发送给 Register 了 ids 的连接（不存在的忽略），只构建一次帧
+	Multicast(ids []string, b []byte, text bool, opts *BroadcastOptions) error
+	// Kick 以 code 关闭 Register 了 id 的连接（CloseType_kicked），code、reason 的检查同 Chum.CloseWithCode
+	Kick(id string, code int, reason string) error
+	// 当前的连接数及 team 数
+	Count() int
+	TeamCount() int
+
+	// Shutdown 停止接受新连接，向所有连接发送 1001 关闭帧，
+	// 等待正在执行的 handler 及待写数据完成后释放所有资源。
+	// ctx 结束时不再等待，直接关闭剩余的连接
+	Shutdown(ctx context.Context) error
+	// Close 立刻关闭所有连接并释放资源
+	Close() error
 }
 
 type Config struct {
 	Upgrader        *ws.Upgrader
 	Timeout         time.Duration
 	TimeoutInterval time.Duration
+	// 单条消息的最大长度（跨帧时为总长度），超出则关闭连接
+	MaxMessageSize int64
+	// 严格遵循 RFC 6455：拒绝没有 mask 的帧、校验控制帧及分片的顺序，
+	// 违反时以 1002 关闭连接
+	Strict bool
+	// 校验文本消息（包括关闭帧的原因）是否为合法的 UTF-8，失败时以 1007 关闭连接；
+	// 同时 WriteFrame、Broadcast 发送非法的文本时返回 Error_utf8
+	ValidateUTF8 bool
+	// 开启 permessage-deflate 压缩，nil 为不压缩
+	Compression *Compression
+	// 收到没有注册的 action（且没有 DefaultRouter）时的处理，默认为 UnknownAction_close
+	UnknownAction int
+	// UnknownAction_reply 时回复的 action，数据为未知的 action（varint 编码）
+	UnknownReply uint32
+	// 开启命名的 action，nil 时忽略 Router.Name
+	NamedActions *NamedActions
+	// RPC 回复使用的 action（见 RPC、Chum.Call），0 为 0xFFFFFFFE
+	RPCReply uint32
+	// 每个连接最多待写（写不进 socket 而排队）的字节数，0 为不限制。
+	// 队列为空时总是接受新的消息，所以单条消息可以超过该值
+	MaxPending int
+	// 超出 MaxPending 时的处理，默认为 SlowPolicy_close
+	SlowPolicy int
+	// SlowPolicy_block 时直接写入最长的等待时间，0 为 1 秒
+	SlowTimeout time.Duration
+
+	// 升级握手时调用，可返回 *Rejection 指定拒绝的 HTTP 状态码（默认 403）。
+	// 返回的 claims 可在 handler 中通过 Chum.Claims 获取
+	Authorize func(req *Request) (claims interface{}, err error)
+	// 升级完成、加入 kpoll 之前调用，返回 error 则拒绝该连接
+	OnConnect func(chum Chum) error
+	// 连接关闭后调用，此时 chum 只可用于读取 Id 等状态
+	OnClose func(chum Chum, reason CloseReason)
+	// 协议错误、读写出错或 handler panic（*PanicError）时调用（随后会关闭连接并调用 OnClose）
+	OnError func(chum Chum, err error)
 }
 
 var (
 	defaultConfig = &Config{
 		Timeout:         time.Minute * 4,
 		TimeoutInterval: time.Minute,
+		MaxMessageSize:  max_message_size,
 	}
 )
 
@@ -63,6 +207,41 @@ func New(config *Config) Party {
 		upgrader:        config.Upgrader,
 		timeout:         int64(config.Timeout),
 		timeoutInterval: int64(config.TimeoutInterval),
+		maxMessageSize:  uint64(config.MaxMessageSize),
+		strict:          config.Strict,
+		validateUTF8:    config.ValidateUTF8,
+		authorize:       config.Authorize,
+		onConnect:       config.OnConnect,
+		onClose:         config.OnClose,
+		onError:         config.OnError,
+		unknownAction:   config.UnknownAction,
+		unknownReply:    config.UnknownReply,
+		rpcReply:        config.RPCReply,
+		maxPending:      config.MaxPending,
+		slowPolicy:      config.SlowPolicy,
+		slowTimeout:     config.SlowTimeout,
+	}
+	if self.rpcReply == 0 {
+		self.rpcReply = rpc_reply
+	}
+	if self.slowTimeout <= 0 {
+		self.slowTimeout = slow_timeout
+	}
+	self.routers.Store(&routerTable{
+		routers: map[uint32]Router{},
+	})
+	if nil != config.NamedActions {
+		named := *config.NamedActions
+		if named.Action == 0 {
+			named.Action = names_action
+		}
+		if named.Base == 0 {
+			named.Base = names_base
+		}
+		self.named = &named
+		self.names = map[string]uint32{}
+		self.nextName = named.Base
+		self.update(func(table *routerTable) {})
 	}
 	if self.timeout <= 0 {
 		self.timeout = int64(defaultConfig.Timeout)
@@ -70,14 +249,31 @@ func New(config *Config) Party {
 	if self.timeoutInterval <= 0 {
 		self.timeoutInterval = int64(defaultConfig.TimeoutInterval)
 	}
+	if nil != config.Compression {
+		self.compressor = newCompressor(config.Compression)
+	}
+	if config.MaxMessageSize <= 0 {
+		self.maxMessageSize = uint64(defaultConfig.MaxMessageSize)
+	} else if config.MaxMessageSize > math.MaxUint32 {
+		// 应用数据长度为 32 位
+		self.maxMessageSize = math.MaxUint32
+	}
 	return self
 }
 
 func (self *party) Listen(network, address string) (err error) {
+	if !atomic.CompareAndSwapUint32(&self.state, party_idle, party_running) {
+		if atomic.LoadUint32(&self.state) == party_running {
+			return Error_party_running
+		}
+		return Error_party_closed
+	}
 	ln, err := net.Listen(network, address)
 	if nil != err {
+		atomic.StoreUint32(&self.state, party_idle)
 		return
 	}
+	self.ln = ln
 
 	if nil == self.upgrader {
 		self.upgrader = &ws.Upgrader{
@@ -86,21 +282,31 @@ func (self *party) Listen(network, address string) (err error) {
 		}
 	}
 
-	poollAccept := pooll.New(&pooll.Config{
+	self.poollAccept = pooll.New(&pooll.Config{
 		Handler: func(v interface{}) {
 			conn, err := ln.Accept()
 			if nil != err {
-				self.wakeup <- struct{}{}
+				self.wake()
 				return
 			}
 			if nil != conn.SetReadDeadline(time.Now().Add(time.Millisecond*20)) {
 				conn.Close()
 				return
 			}
-			_, err = self.upgrader.Upgrade(conn)
+			var req *Request
+			var claims interface{}
+			var params *wsflate.Parameters
+			upgrader := self.upgrader
+			if nil != self.authorize || nil != self.compressor {
+				if nil != self.authorize {
+					req = &Request{}
+				}
+				upgrader = self.connUpgrader(conn, req, &claims, &params)
+			}
+			_, err = upgrader.Upgrade(conn)
 			if nil != err {
 				conn.Close()
-				self.wakeup <- struct{}{}
+				self.wake()
 				return
 			}
 			if nil != conn.SetReadDeadline(time.Time{}) {
@@ -109,12 +315,31 @@ func (self *party) Listen(network, address string) (err error) {
 			}
 
 			chum := &chum{
-				Conn:   conn,
-				fd:     kpoll.Sysfd_unsafe(conn),
-				party:  self,
-				active: timer.Now(),
+				Conn:    conn,
+				fd:      kpoll.Sysfd_unsafe(conn),
+				party:   self,
+				active:  timer.Now(),
+				utf8:    utf8_none,
+				request: req,
+				claims:  claims,
+			}
+			chum.frame.Strict = self.strict
+			chum.frame.MaxPayload = self.maxMessageSize
+			chum.message.Lookup = chum.lookup
+			if nil != params {
+				chum.deflate = &deflate{
+					takeover: !params.ClientNoContextTakeover,
+				}
+				// permessage-deflate 使用 rsv1
+				chum.frame.Rsv = 0x40
 			}
 			self.chumsLK.Lock()
+			if atomic.LoadUint32(&self.state) != party_running {
+				// 升级期间 Shutdown、Close 已开始，它们之后取的快照可能不包含该连接，直接关闭
+				self.chumsLK.Unlock()
+				conn.Close()
+				return
+			}
 			self.chums[chum.fd] = chum
 			if nil == self.head {
 				self.head = chum
@@ -124,6 +349,23 @@ func (self *party) Listen(network, address string) (err error) {
 			}
 			self.last = chum
 			self.chumsLK.Unlock()
+			if nil != self.onConnect {
+				if perr := guard("OnConnect", func() {
+					err = self.onConnect(chum)
+				}); nil != perr {
+					chum.closeWithCode(false, CloseCode_internal, "", CloseReason{Type: CloseType_panic, Code: CloseCode_internal, Err: perr})
+					self.awaitClose(chum)
+					return
+				}
+				if nil != err {
+					chum.closeWithCode(false, CloseCode_policy, "", CloseReason{Type: CloseType_reject, Code: CloseCode_policy, Err: err})
+					self.awaitClose(chum)
+					return
+				}
+			}
+			if nil != self.named && self.named.Push {
+				chum.WriteFrame(self.table().names, false)
+			}
 			self.kpoller.Add(chum.fd, kpoll.KEV_READ|kpoll.KEF_ET)
 		},
 	})
@@ -132,6 +374,7 @@ func (self *party) Listen(network, address string) (err error) {
 	self.chums = make(map[int]*chum)
 	self.teams = make(map[string]*team)
 	self.wakeup = make(chan struct{}, 1)
+	self.done = make(chan struct{})
 
 	self.poollTeam = pooll.New(&pooll.Config{
 		Max: 1,
@@ -144,11 +387,12 @@ func (self *party) Listen(network, address string) (err error) {
 	})
 
 	skFd := kpoll.Sysfd_unsafe(ln)
+	self.skFd = skFd
 	self.kpoller, err = kpoll.New(func(events []kpoll.KEvent_t) {
 		lk := 0
 		for i, l := 0, len(events); i < l; i++ {
 			if events[i].Fd == skFd {
-				poollAccept.Put(nil)
+				self.poollAccept.Put(nil)
 			} else {
 				if lk == 0 {
 					lk = 1
@@ -164,7 +408,7 @@ func (self *party) Listen(network, address string) (err error) {
 						lk = 0
 						self.chumsLK.RUnlock()
 					}
-					chum.Close()
+					chum.fail(CloseType_error, 0, io.EOF)
 				case events[i].Event&kpoll.KEV_READ != 0:
 					self.poollRead.Put(chum)
 				case events[i].Event&kpoll.KEV_WRITE != 0:
@@ -177,6 +421,12 @@ func (self *party) Listen(network, address string) (err error) {
 		}
 	})
 	if nil != err {
+		ln.Close()
+		self.poollAccept.Rel()
+		self.poollTeam.Rel()
+		self.poollRead.Rel()
+		self.poollWrite.Rel()
+		atomic.StoreUint32(&self.state, party_closed)
 		return
 	}
 	self.kpoller.Add(skFd, kpoll.KEV_READ|kpoll.KEF_ET)
@@ -185,12 +435,216 @@ func (self *party) Listen(network, address string) (err error) {
 	return
 }
 
+// 不可变的 router 表
+type routerTable struct {
+	routers map[uint32]Router
+	// 没有注册的 action 交给该 router 处理
+	defaultRouter *Router
+	// 命名 action 的映射（NamedActions 不为 nil 时）
+	names []byte
+}
+
+func (self *party) table() *routerTable {
+	return self.routers.Load().(*routerTable)
+}
+
+// 复制当前的 router 表，修改后替换，调用者需持有 routersLK
+func (self *party) update(f func(table *routerTable)) {
+	old := self.table()
+	table := &routerTable{
+		routers:       make(map[uint32]Router, len(old.routers)),
+		defaultRouter: old.defaultRouter,
+	}
+	for k, v := range old.routers {
+		table.routers[k] = v
+	}
+	f(table)
+	if nil != self.named {
+		table.names = self.manifest(table)
+	}
+	self.routers.Store(table)
+}
+
 func (self *party) AddRouters(routers ...Router) {
-	if nil == self.routers {
-		self.routers = make(map[uint32]Router, len(routers))
+	self.routersLK.Lock()
+	self.update(func(table *routerTable) {
+		for _, v := range routers {
+			if v.Name != "" && nil != self.named {
+				v.Action = self.assign(table, v.Name)
+			}
+			table.routers[v.Action] = self.chain(v)
+		}
+	})
+	self.routersLK.Unlock()
+}
+
+func (self *party) RemoveRouters(actions ...uint32) {
+	self.routersLK.Lock()
+	self.update(func(table *routerTable) {
+		for _, v := range actions {
+			delete(table.routers, v)
+		}
+	})
+	self.routersLK.Unlock()
+}
+
+func (self *party) Actions() []uint32 {
+	table := self.table()
+	actions := make([]uint32, 0, len(table.routers))
+	for k := range table.routers {
+		actions = append(actions, k)
 	}
-	for _, v := range routers {
-		self.routers[v.Action] = v
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i] < actions[j]
+	})
+	return actions
+}
+
+func (self *party) SetDefaultRouter(router Router) {
+	self.routersLK.Lock()
+	router = self.chain(router)
+	self.update(func(table *routerTable) {
+		table.defaultRouter = &router
+	})
+	self.routersLK.Unlock()
+}
+
+func (self *party) Use(middlewares ...Middleware) {
+	self.routersLK.Lock()
+	self.middlewares = append(self.middlewares, middlewares...)
+	// 重新组合已添加的 router
+	self.update(func(table *routerTable) {
+		for k, v := range table.routers {
+			table.routers[k] = self.chain(v)
+		}
+		if nil != table.defaultRouter {
+			router := self.chain(*table.defaultRouter)
+			table.defaultRouter = &router
+		}
+	})
+	self.routersLK.Unlock()
+}
+
+// 按 Party.Use、Router.Middlewares 的顺序由外到内包装 handler
+func (self *party) chain(router Router) Router {
+	handler := router.Handler
+	if nil != handler {
+		for i := len(router.Middlewares) - 1; i >= 0; i-- {
+			handler = router.Middlewares[i](handler)
+		}
+		for i := len(self.middlewares) - 1; i >= 0; i-- {
+			handler = self.middlewares[i](handler)
+		}
+	}
+	router.handler = handler
+	return router
+}
+
+func (self *party) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&self.state, party_running, party_shutdown) {
+		return Error_party_closed
+	}
+	// 停止接受新连接
+	self.kpoller.Del(self.skFd)
+	self.ln.Close()
+
+	// 通知所有连接即将离开（1001 going away）
+	for _, chum := range self.snapshot() {
+		chum.closeWithCode(false, CloseCode_away, "", CloseReason{Type: CloseType_shutdown, Code: CloseCode_away})
+	}
+
+	ticker := time.NewTicker(shutdown_interval)
+	defer ticker.Stop()
+	for !self.drained() {
+		select {
+		case <-ctx.Done():
+			self.release()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	self.release()
+	return nil
+}
+
+func (self *party) Close() error {
+	if !atomic.CompareAndSwapUint32(&self.state, party_running, party_shutdown) {
+		if atomic.LoadUint32(&self.state) != party_shutdown {
+			return Error_party_closed
+		}
+	} else {
+		self.kpoller.Del(self.skFd)
+		self.ln.Close()
+	}
+	self.release()
+	return nil
+}
+
+// 当前所有连接的快照（避免持锁调用 chum 的方法）
+func (self *party) snapshot() []*chum {
+	self.chumsLK.RLock()
+	chums := make([]*chum, 0, len(self.chums))
+	for chum := self.head; nil != chum; chum = chum.anext {
+		chums = append(chums, chum)
+	}
+	self.chumsLK.RUnlock()
+	return chums
+}
+
+// 所有连接都已关闭（完成关闭握手或超过 close_timeout）
+func (self *party) drained() bool {
+	self.chumsLK.RLock()
+	n := len(self.chums)
+	self.chumsLK.RUnlock()
+	return n == 0
+}
+
+func (self *party) release() {
+	if !atomic.CompareAndSwapUint32(&self.state, party_shutdown, party_closed) {
+		return
+	}
+	for _, chum := range self.snapshot() {
+		chum.close(false, CloseReason{Type: CloseType_shutdown})
+	}
+	close(self.done)
+	self.poollAccept.Rel()
+	self.poollRead.Rel()
+	self.poollWrite.Rel()
+	self.poollTeam.Rel()
+	self.kpoller.Close()
+}
+
+// 接受时被拒绝的连接，发送关闭帧后仍需读取对端的回应（读线程只处理控制帧）
+func (self *party) awaitClose(chum *chum) {
+	self.chumsLK.Lock()
+	if !chum.Closed() {
+		// close 在 chumsLK 中从 kpoller 删除，不会先于 Add
+		self.kpoller.Add(chum.fd, kpoll.KEV_READ|kpoll.KEF_ET)
+	}
+	self.chumsLK.Unlock()
+}
+
+// 回调持锁期间关闭的连接的 onClose
+func (self *party) flushClosed() {
+	if nil == self.onClose {
+		return
+	}
+	self.chumsLK.Lock()
+	events := self.closedEvents
+	self.closedEvents = nil
+	self.chumsLK.Unlock()
+	for _, v := range events {
+		guard("OnClose", func() {
+			self.onClose(v.chum, v.reason)
+		})
+		v.chum.clearAttrs()
+	}
+}
+
+func (self *party) wake() {
+	select {
+	case self.wakeup <- struct{}{}:
+	default:
 	}
 }
 
@@ -209,11 +663,14 @@ __loop:
 		// count 防止一次性遍历过多
 		for nil != self.cursor && closed < 1000 && count < 100000 {
 			count++
-			if now >= self.cursor.active+self.timeout {
-				self.cursor.close(true)
+			cursor := self.cursor
+			if atomic.LoadUint32(&cursor.closing) == 0 && now >= cursor.active+self.timeout {
+				cursor.closeWithCode(true, CloseCode_normal, "", CloseReason{Type: CloseType_timeout, Code: CloseCode_normal})
 				closed++
-			} else {
-				self.cursor = self.cursor.anext
+			}
+			if cursor == self.cursor {
+				// 没有立即关闭（等待对端回应关闭帧）
+				self.cursor = cursor.anext
 			}
 			if nil == self.cursor {
 				self.cursor = self.head
@@ -225,6 +682,7 @@ __loop:
 		}
 	}
 	self.chumsLK.Unlock()
+	self.flushClosed()
 	now = timer.Now()
 	if now < self.clock+int64(time.Second) {
 		self.frequently++
@@ -249,6 +707,12 @@ __loop:
 				self.sleep = nil
 			}
 		}
+	case <-self.done:
+		if nil != self.sleep {
+			self.sleep.Stop()
+			self.sleep = nil
+		}
+		return
 	}
 	goto __loop
 }
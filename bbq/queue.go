@@ -0,0 +1,291 @@
+package bbq
+
+import (
+	"github.com/ikCourage/autumn/kpoll"
+	"github.com/ikCourage/autumn/timer"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// writev 一次最多写入的缓冲数
+	max_iovec = 64
+	// SlowPolicy_block 默认的最长等待时间
+	slow_timeout = time.Second
+)
+
+// 引用计数的帧（PBytes 的缓冲），广播时多个连接的发送队列共享同一个，
+// 最后一个引用释放时归还
+type frameBuf struct {
+	b    []byte
+	refs int32
+}
+
+func newFrameBuf(b []byte) *frameBuf {
+	return &frameBuf{b: b, refs: 1}
+}
+
+func (self *frameBuf) retain() {
+	atomic.AddInt32(&self.refs, 1)
+}
+
+func (self *frameBuf) release() {
+	if atomic.AddInt32(&self.refs, -1) == 0 {
+		PBytes.Put(self.b)
+		self.b = nil
+	}
+}
+
+// 发送队列中的一项，private 为 true 时缓冲只属于该连接，可以继续追加
+type outbound struct {
+	buf     *frameBuf
+	private bool
+}
+
+// 写入（复制）只属于该连接的数据，调用者需持有 writeLK
+func (self *chum) writeLocked(b []byte) (nn int, err error) {
+	nn = len(b)
+	if len(self.writeQueue) == 0 {
+		// 尝试写一次
+		var n int
+		if n, err = self.write(b); nil != err {
+			switch err {
+			case syscall.EAGAIN, syscall.EINTR:
+			default:
+				return n, err
+			}
+		}
+		if n == nn {
+			return
+		}
+		b = b[n:]
+		if nil == err {
+			// 加入写线程，否则等待 write 事件
+			defer self.party.poollWrite.Put(self)
+		}
+	}
+	atomic.AddInt64(&self.backlog, int64(len(b)))
+	if l := len(self.writeQueue); l != 0 {
+		if last := &self.writeQueue[l-1]; last.private && cap(last.buf.b)-len(last.buf.b) >= len(b) {
+			// 追加到队尾的缓冲
+			last.buf.b = append(last.buf.b, b...)
+			return nn, nil
+		}
+	}
+	buf := PBytes.Get(len(b), len(b))
+	copy(buf, b)
+	self.writeQueue = append(self.writeQueue, outbound{buf: newFrameBuf(buf), private: true})
+	return nn, nil
+}
+
+// 写入共享的帧，返回需要关闭连接的错误。广播时可能持有队伍的锁，
+// 由调用者在释放锁之后调用 writeFailed，防止在 OnError、OnClose 中重入
+func (self *chum) writeShared(f *frameBuf) error {
+	self.writeLK.Lock()
+	self.queueShared(f)
+	return self.releaseWrite()
+}
+
+// 写不完时队列持有一个引用，不复制数据，调用者需持有 writeLK
+func (self *chum) queueShared(f *frameBuf) (err error) {
+	if self.closing != 0 || self.Closed() {
+		return Error_closed
+	}
+	if err = self.admit(len(f.b), true); nil != err {
+		return
+	}
+	n := 0
+	if len(self.writeQueue) == 0 {
+		if n, err = self.write(f.b); nil != err {
+			switch err {
+			case syscall.EAGAIN, syscall.EINTR:
+			default:
+				return
+			}
+		}
+		if n == len(f.b) {
+			return
+		}
+		self.writeOffset = n
+		if nil == err {
+			defer self.party.poollWrite.Put(self)
+		}
+	}
+	f.retain()
+	atomic.AddInt64(&self.backlog, int64(len(f.b)-n))
+	self.writeQueue = append(self.writeQueue, outbound{buf: f})
+	return nil
+}
+
+// 由写线程调用，用 writev 一次写入队列中的多个缓冲，直到写完或 EAGAIN
+func (self *chum) writeLoop() error {
+	var iovs [max_iovec][]byte
+	self.writeLK.Lock()
+	for len(self.writeQueue) != 0 {
+		l := 0
+		for _, o := range self.writeQueue {
+			if l == max_iovec {
+				break
+			}
+			iovs[l] = o.buf.b
+			l++
+		}
+		iovs[0] = iovs[0][self.writeOffset:]
+		n, err := self.writev(iovs[:l])
+		for i := 0; i < l; i++ {
+			iovs[i] = nil
+		}
+		self.consume(n)
+		if nil != err {
+			self.unlockWrite()
+			return err
+		}
+	}
+	if self.closing == closing_done {
+		// 关闭帧已写完，且已收到对端的关闭帧
+		self.unlockWrite()
+		self.close(false, self.closeReason)
+		return nil
+	}
+	// #ctr 重新侦听 read
+	self.party.kpoller.Mod(self.fd, kpoll.KEV_READ|kpoll.KEF_ET)
+	self.unlockWrite()
+	return nil
+}
+
+// 释放 writeLK，写入出错时关闭连接（close 需要 writeLK，所以不能在持有时关闭）
+func (self *chum) unlockWrite() {
+	self.writeFailed(self.releaseWrite())
+}
+
+// 释放 writeLK，返回需要关闭连接的错误
+func (self *chum) releaseWrite() error {
+	err := self.writeErr
+	self.writeErr = nil
+	self.writeLK.Unlock()
+	return err
+}
+
+// 写入出错时关闭连接，不能持有 writeLK
+func (self *chum) writeFailed(err error) {
+	switch err {
+	case nil:
+	case Error_backlog:
+		self.fail(CloseType_slow, CloseCode_policy, err)
+	default:
+		self.fail(CloseType_error, 0, err)
+	}
+}
+
+// 从队首移除已写的 n 字节，释放写完的缓冲
+func (self *chum) consume(n int) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddInt64(&self.backlog, -int64(n))
+	if nil != self.writeCond {
+		self.writeCond.Broadcast()
+	}
+	for n > 0 {
+		o := &self.writeQueue[0]
+		l := len(o.buf.b) - self.writeOffset
+		if n < l {
+			self.writeOffset += n
+			return
+		}
+		n -= l
+		o.buf.release()
+		*o = outbound{}
+		self.writeQueue = self.writeQueue[1:]
+		self.writeOffset = 0
+	}
+	if len(self.writeQueue) == 0 {
+		self.writeQueue = nil
+	}
+}
+
+// 丢弃所有待写的数据，调用者需持有 writeLK
+func (self *chum) releaseQueue() {
+	for i := range self.writeQueue {
+		self.writeQueue[i].buf.release()
+	}
+	self.writeQueue = nil
+	self.writeOffset = 0
+	atomic.StoreInt64(&self.backlog, 0)
+	if nil != self.writeCond {
+		self.writeCond.Broadcast()
+	}
+}
+
+func (self *chum) Backlog() int {
+	return int(atomic.LoadInt64(&self.backlog))
+}
+
+// 写入 n 字节之前检查待写的数据是否超出 maxPending，返回 nil 表示可以写入。
+// 调用者需持有 writeLK，SlowPolicy_block 时会在等待期间释放。
+// shared 为广播等共享的帧，发送方可能持有队伍的锁并依次写给每个成员，不能阻塞，
+// SlowPolicy_block 时按 SlowPolicy_drop 处理
+func (self *chum) admit(n int, shared bool) error {
+	party := self.party
+	max := int64(party.maxPending)
+	if max <= 0 || self.closing != 0 || len(self.writeQueue) == 0 || self.backlog+int64(n) <= max {
+		return nil
+	}
+	switch party.slowPolicy {
+	case SlowPolicy_drop:
+	case SlowPolicy_drop_oldest:
+		if self.drop(self.backlog + int64(n) - max) {
+			return nil
+		}
+	case SlowPolicy_block:
+		if shared {
+			break
+		}
+		if nil == self.writeCond {
+			self.writeCond = sync.NewCond(&self.writeLK)
+		}
+		deadline := timer.Now() + int64(party.slowTimeout)
+		// 到时唤醒
+		timer.After(party.slowTimeout, self.writeCond.Broadcast)
+		for len(self.writeQueue) != 0 && self.backlog+int64(n) > max {
+			if self.closing != 0 || self.Closed() {
+				return Error_closed
+			}
+			if timer.Now() >= deadline {
+				return Error_backlog
+			}
+			self.writeCond.Wait()
+		}
+		// 队列可能是因为关闭帧已写完或 close 释放了队列而变空
+		if self.closing != 0 || self.Closed() {
+			return Error_closed
+		}
+		return nil
+	default:
+		// 由 unlockWrite 关闭连接
+		self.writeErr = Error_backlog
+	}
+	return Error_backlog
+}
+
+// 从队首开始丢弃可丢弃的消息（还未开始写的广播），直到释放了 need 字节，返回是否足够
+func (self *chum) drop(need int64) bool {
+	var freed int64
+	q := self.writeQueue[:0]
+	for i, o := range self.writeQueue {
+		if freed < need && !o.private && (i != 0 || self.writeOffset == 0) {
+			freed += int64(len(o.buf.b))
+			o.buf.release()
+			continue
+		}
+		q = append(q, o)
+	}
+	for i := len(q); i < len(self.writeQueue); i++ {
+		self.writeQueue[i] = outbound{}
+	}
+	self.writeQueue = q
+	atomic.AddInt64(&self.backlog, -freed)
+	return freed >= need
+}
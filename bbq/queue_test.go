@@ -0,0 +1,209 @@
+package bbq
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ikCourage/autumn/bbq/client"
+	"github.com/ikCourage/autumn/bbq/wire"
+)
+
+// 在 timeout 内等待 f 返回 true
+func eventually(t *testing.T, timeout time.Duration, f func() bool) bool {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if f() {
+			return true
+		}
+	}
+	return f()
+}
+
+func newFrame(n int) *frameBuf {
+	return newFrameBuf(PBytes.Get(n, n))
+}
+
+// 多个慢连接共享同一组帧，全部写完后引用计数归零，Backlog 回到 0
+func TestSharedFrameRelease(t *testing.T) {
+	p := New(nil).(*party)
+	if err := p.Listen("tcp", "127.0.0.1:0"); nil != err {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	addr := "ws://" + p.ln.Addr().String() + "/"
+
+	const clients = 3
+	const count = 200
+	body := bytes.Repeat([]byte("x"), 64<<10)
+	block := make(chan struct{})
+	received := make(chan struct{}, clients)
+	for i := 0; i < clients; i++ {
+		next := 0
+		c := client.New(&client.Config{MaxMessageSize: 1 << 20})
+		c.AddRouters(client.Router{Type: client.ActionType_all, Action: 9, Handler: func(c client.Client, b []byte) {
+			if next == 0 {
+				// 不读，让服务端的发送队列堆积
+				<-block
+			}
+			if next++; next == count {
+				received <- struct{}{}
+			}
+		}})
+		if err := c.Dial(context.Background(), addr); nil != err {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	if !eventually(t, 2*time.Second, func() bool { return p.Count() == clients }) {
+		t.Fatal("clients not connected")
+	}
+	chums := p.snapshot()
+
+	frames := make([]*frameBuf, 0, count)
+	msg := append(wire.AppendAction(nil, 9), body...)
+	for i := 0; i < count; i++ {
+		bs, cbs, err := p.broadcastFrames(msg, false)
+		if nil != err {
+			t.Fatal(err)
+		}
+		for _, chum := range chums {
+			chum.writeFrames(bs, cbs)
+		}
+		frames = append(frames, bs)
+		putFrames(bs, cbs)
+	}
+	for _, chum := range chums {
+		if chum.Backlog() == 0 {
+			t.Fatal("expected pending data for a slow client")
+		}
+	}
+	if atomic.LoadInt32(&frames[count-1].refs) != clients {
+		t.Fatalf("refs = %d, want %d", atomic.LoadInt32(&frames[count-1].refs), clients)
+	}
+
+	close(block)
+	for i := 0; i < clients; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting clients")
+		}
+	}
+	ok := eventually(t, 2*time.Second, func() bool {
+		for _, chum := range chums {
+			if chum.Backlog() != 0 {
+				return false
+			}
+		}
+		return true
+	})
+	if !ok {
+		t.Fatal("backlog not drained")
+	}
+	for i, f := range frames {
+		if refs := atomic.LoadInt32(&f.refs); refs != 0 {
+			t.Fatalf("frame %d refs = %d", i, refs)
+		}
+	}
+}
+
+// SlowPolicy_drop_oldest 不能丢弃已写了一部分的队首
+func TestDropOldestKeepsPartialHead(t *testing.T) {
+	c := &chum{party: &party{maxPending: 10, slowPolicy: SlowPolicy_drop_oldest}}
+	head, private, shared := newFrame(8), newFrame(4), newFrame(6)
+	c.writeQueue = []outbound{{buf: head}, {buf: private, private: true}, {buf: shared}}
+	c.writeOffset = 3
+	c.backlog = 5 + 4 + 6
+
+	c.writeLK.Lock()
+	err := c.admit(1, true)
+	c.writeLK.Unlock()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(c.writeQueue) != 2 || c.writeQueue[0].buf != head || c.writeQueue[1].buf != private {
+		t.Fatal("unexpected queue after drop")
+	}
+	if c.writeOffset != 3 || c.Backlog() != 9 {
+		t.Fatalf("offset = %d, backlog = %d", c.writeOffset, c.Backlog())
+	}
+	if atomic.LoadInt32(&shared.refs) != 0 || atomic.LoadInt32(&head.refs) != 1 {
+		t.Fatal("wrong frame released")
+	}
+
+	// 只剩下队首和私有的数据，不够时丢弃新的消息
+	c.writeLK.Lock()
+	err = c.admit(4, true)
+	c.writeLK.Unlock()
+	if err != Error_backlog {
+		t.Fatalf("err = %v, want Error_backlog", err)
+	}
+	if len(c.writeQueue) != 2 || c.writeOffset != 3 || c.Backlog() != 9 {
+		t.Fatal("partial head dropped")
+	}
+
+	c.writeLK.Lock()
+	c.releaseQueue()
+	c.writeLK.Unlock()
+	if c.Backlog() != 0 || atomic.LoadInt32(&head.refs) != 0 || atomic.LoadInt32(&private.refs) != 0 {
+		t.Fatal("queue not released")
+	}
+}
+
+// SlowPolicy_block 等待期间连接开始关闭，返回 Error_closed 而不是继续写入
+func TestBlockReturnsClosed(t *testing.T) {
+	c := &chum{party: &party{maxPending: 10, slowPolicy: SlowPolicy_block, slowTimeout: 5 * time.Second}}
+	c.writeQueue = []outbound{{buf: newFrame(8), private: true}}
+	c.backlog = 8
+
+	done := make(chan error, 1)
+	go func() {
+		c.writeLK.Lock()
+		done <- c.admit(4, false)
+		c.writeLK.Unlock()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("admit returned %v before the queue drained", err)
+	default:
+	}
+	// 与 close 相同：释放队列后队列为空
+	c.writeLK.Lock()
+	atomic.StoreUint32(&c.closing, 1)
+	c.releaseQueue()
+	c.writeLK.Unlock()
+	select {
+	case err := <-done:
+		if err != Error_closed {
+			t.Fatalf("err = %v, want Error_closed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("admit still blocked")
+	}
+
+	// 没有关闭时，超时后丢弃新的消息
+	d := &chum{party: &party{maxPending: 10, slowPolicy: SlowPolicy_block, slowTimeout: 50 * time.Millisecond}}
+	d.writeQueue = []outbound{{buf: newFrame(8), private: true}}
+	d.backlog = 8
+	d.writeLK.Lock()
+	err := d.admit(4, false)
+	d.writeLK.Unlock()
+	if err != Error_backlog {
+		t.Fatalf("err = %v, want Error_backlog", err)
+	}
+	// 广播的帧不阻塞
+	d.writeLK.Lock()
+	start := time.Now()
+	err = d.admit(4, true)
+	d.writeLK.Unlock()
+	if err != Error_backlog || time.Since(start) > 20*time.Millisecond {
+		t.Fatalf("shared admit: err = %v after %v", err, time.Since(start))
+	}
+	d.writeLK.Lock()
+	d.releaseQueue()
+	d.writeLK.Unlock()
+}
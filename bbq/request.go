@@ -0,0 +1,136 @@
+package bbq
+
+import (
+	"bytes"
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// 升级握手时解析到的 HTTP 请求
+type Request struct {
+	URI        string
+	URL        *url.URL
+	Header     http.Header
+	RemoteAddr net.Addr
+}
+
+// Authorize 返回 *Rejection 时，以 Status 拒绝升级
+type Rejection struct {
+	Status int
+	Reason string
+}
+
+func (self *Request) Cookies() []*http.Cookie {
+	return (&http.Request{Header: self.Header}).Cookies()
+}
+
+func (self *Request) Cookie(name string) (*http.Cookie, error) {
+	return (&http.Request{Header: self.Header}).Cookie(name)
+}
+
+func (self *Rejection) Error() string {
+	if self.Reason != "" {
+		return self.Reason
+	}
+	return http.StatusText(self.Status)
+}
+
+// 为每个连接生成独立的 Upgrader，在握手期间收集请求信息并调用 authorize，
+// 以及协商 permessage-deflate
+func (self *party) connUpgrader(conn net.Conn, req *Request, claims *interface{}, flate **wsflate.Parameters) *ws.Upgrader {
+	u := *self.upgrader
+	if nil != self.compressor {
+		negotiate := u.Negotiate
+		u.Negotiate = func(opt httphead.Option) (httphead.Option, error) {
+			if bytes.Equal(opt.Name, wsflate.ExtensionNameBytes) {
+				return self.compressor.negotiate(opt, flate)
+			}
+			if nil != negotiate {
+				return negotiate(opt)
+			}
+			return httphead.Option{}, nil
+		}
+	}
+	if nil == self.authorize {
+		return &u
+	}
+	onRequest := u.OnRequest
+	onHost := u.OnHost
+	onHeader := u.OnHeader
+	protocol := u.Protocol
+	protocolCustom := u.ProtocolCustom
+	onBeforeUpgrade := u.OnBeforeUpgrade
+	req.Header = make(http.Header)
+	req.RemoteAddr = conn.RemoteAddr()
+	u.OnRequest = func(uri []byte) (err error) {
+		req.URI = string(uri)
+		if req.URL, err = url.ParseRequestURI(req.URI); nil != err {
+			return ws.RejectConnectionError(ws.RejectionStatus(http.StatusBadRequest))
+		}
+		if nil != onRequest {
+			return onRequest(uri)
+		}
+		return nil
+	}
+	// Host、Sec-WebSocket-Protocol 不会交给 OnHeader，需单独记录
+	// （浏览器无法设置自定义的头，常将 token 放在子协议中）
+	u.OnHost = func(host []byte) error {
+		req.Header.Set("Host", string(host))
+		if nil != onHost {
+			return onHost(host)
+		}
+		return nil
+	}
+	u.ProtocolCustom = func(v []byte) (string, bool) {
+		req.Header.Add("Sec-WebSocket-Protocol", string(v))
+		if nil != protocolCustom {
+			return protocolCustom(v)
+		}
+		// 与 ws.Upgrader 相同，选择第一个 Protocol 返回 true 的子协议
+		var selected string
+		ok := httphead.ScanTokens(v, func(p []byte) bool {
+			if nil != protocol && protocol(p) {
+				selected = string(p)
+				return false
+			}
+			return true
+		})
+		return selected, ok
+	}
+	u.OnHeader = func(key, value []byte) error {
+		req.Header.Add(string(key), string(value))
+		if nil != onHeader {
+			return onHeader(key, value)
+		}
+		return nil
+	}
+	u.OnBeforeUpgrade = func() (header ws.HandshakeHeader, err error) {
+		if nil != onBeforeUpgrade {
+			if header, err = onBeforeUpgrade(); nil != err {
+				return
+			}
+		}
+		if perr := guard("Authorize", func() {
+			*claims, err = self.authorize(req)
+		}); nil != perr {
+			// 连接会由 accept 关闭
+			return nil, ws.RejectConnectionError(ws.RejectionStatus(http.StatusInternalServerError))
+		}
+		if nil != err {
+			status := http.StatusForbidden
+			if v, ok := err.(*Rejection); ok && v.Status != 0 {
+				status = v.Status
+			}
+			return nil, ws.RejectConnectionError(
+				ws.RejectionStatus(status),
+				ws.RejectionReason(err.Error()),
+			)
+		}
+		return
+	}
+	return &u
+}
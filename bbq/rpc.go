@@ -0,0 +1,80 @@
+package bbq
+
+import (
+	"github.com/ikCourage/autumn/bbq/wire"
+	"time"
+)
+
+const (
+	// 默认的 RPC 回复 action
+	rpc_reply = wire.RPC_reply
+)
+
+var (
+	Error_timeout = wire.Error_timeout
+)
+
+// 对端返回的错误
+type RPCError = wire.RPCError
+
+// RPC 返回处理请求的 router（ActionType_all），handler 返回的数据自动回复给对端，
+// 返回 error 时回复错误信息。可像其它 router 一样设置 Name、Middlewares
+func RPC(action uint32, handler func(chum Chum, req []byte) (resp []byte, err error)) Router {
+	return Router{
+		Type:   ActionType_all,
+		Action: action,
+		Handler: func(c Chum) {
+			self := c.(*chum)
+			id, req, err := wire.ReadRequest(self.Data())
+			if nil != err {
+				self.fail(CloseType_protocol, CloseCode_protocol, err)
+				return
+			}
+			resp, err := handler(c, req)
+			self.reply(id, func(dst []byte) ([]byte, error) {
+				return append(dst, resp...), err
+			})
+		},
+	}
+}
+
+// 回复 RPC，encode 把回复的数据追加到 dst，返回 error 时改为回复错误信息
+func (self *chum) reply(id uint32, encode func(dst []byte) ([]byte, error)) {
+	b := PBytes.Get(0, read_size)
+	b = wire.AppendReply(b, self.party.rpcReply, id, wire.RPC_ok)
+	bs, err := encode(b)
+	if nil != err {
+		bs = wire.AppendReply(b[:0], self.party.rpcReply, id, wire.RPC_error)
+		bs = append(bs, err.Error()...)
+	}
+	self.WriteFrame(bs, false)
+	PBytes.Put(bs)
+}
+
+// 调用客户端的 RPC，收到回复、超时或连接关闭时在其它线程回调 callback（不要在其中阻塞），
+// timeout 为 0 时不超时
+func (self *chum) Call(action uint32, req []byte, timeout time.Duration, callback func(resp []byte, err error)) (err error) {
+	id, ok := self.calls.Add(callback)
+	if !ok {
+		return Error_closed
+	}
+	b := PBytes.Get(0, len(req)+wire.MaxActionBytes*2)
+	b = wire.AppendRequest(b, action, id)
+	b = append(b, req...)
+	_, err = self.WriteFrame(b, false)
+	PBytes.Put(b)
+	if nil != err {
+		self.calls.Take(id)
+		return
+	}
+	self.calls.Expire(id, timeout)
+	return
+}
+
+// 收到客户端的回复
+func readReply(c Chum) {
+	self := c.(*chum)
+	if err := self.calls.Reply(self.Data()); nil != err {
+		self.fail(CloseType_protocol, CloseCode_protocol, err)
+	}
+}
@@ -1,6 +1,7 @@
 package bbq
 
 import (
+	"bytes"
 	"github.com/ikCourage/autumn/timer"
 	"sync"
 	"time"
@@ -10,139 +11,233 @@ const (
 	broadcast_delay = time.Second
 )
 
+// 一组连接，Chum.Join 时创建，没有成员时删除
+type Team interface {
+	Id() string
+	// 成员数
+	Len() int
+	Chums() []Chum
+	// 发送给所有成员，delay、opts 同 Chum.Broadcast
+	Broadcast(b []byte, text bool, delay time.Duration, opts *BroadcastOptions) error
+}
+
 type team struct {
 	party  *party
 	id     string
 	rwLK   sync.RWMutex
-	head   *chum
-	last   *chum
+	chums  map[*chum]struct{}
 	msgLK  sync.Mutex
-	msgMap map[int]struct{}
-	length uint32
+	msgMap map[int][]*pending  // 延迟发送的广播，按数据的 hash 分组
+	keyed  map[string]*pending // 延迟发送的广播，按 BroadcastOptions.Key
+}
+
+// 等待延迟发送的广播
+type pending struct {
+	sender *chum
+	bs     *frameBuf
+	cbs    *frameBuf
+	opts   *BroadcastOptions
 }
 
 func newTeam(party *party, id string) *team {
 	return &team{
 		party:  party,
 		id:     id,
-		msgMap: make(map[int]struct{}),
+		chums:  make(map[*chum]struct{}),
+		msgMap: make(map[int][]*pending),
+		keyed:  make(map[string]*pending),
 	}
 }
 
-func (self *team) add(chum *chum) {
-	self.party.poollTeam.Put(func() {
-		self.rwLK.Lock()
-		if nil == self.head {
-			self.head = chum
-		} else {
-			chum.prev = self.last
-			self.last.next = chum
-		}
-		chum.team = self
-		self.last = chum
-		self.length++
-		self.rwLK.Unlock()
+// 成员的变更都在 poollTeam（只有一个线程）中按调用顺序执行，
+// 所以与 close 的 leaveAll 不会交错：close 之后的 join 会看到连接已关闭
+
+func (self *party) join(chum *chum, id string) {
+	self.poollTeam.Put(func() {
 		if chum.Closed() {
-			// why? 防止内存泄漏
-			self.remove(chum)
+			return
 		}
+		chum.teamsLK.Lock()
+		defer chum.teamsLK.Unlock()
+		if _, ok := chum.teams[id]; ok {
+			return
+		}
+		self.teamsLK.Lock()
+		t, ok := self.teams[id]
+		if !ok {
+			t = newTeam(self, id)
+			self.teams[id] = t
+		}
+		self.teamsLK.Unlock()
+		t.rwLK.Lock()
+		t.chums[chum] = struct{}{}
+		t.rwLK.Unlock()
+		if nil == chum.teams {
+			chum.teams = make(map[string]*team)
+		}
+		chum.teams[id] = t
 	})
 }
 
-func (self *team) remove(chum *chum) {
-	self.party.poollTeam.Put(func() {
-		if self == chum.team {
-			self.rwLK.Lock()
-			if self.length != 0 {
-				if nil != chum.next {
-					chum.next.prev = chum.prev
-				}
-				if nil != chum.prev {
-					chum.prev.next = chum.next
-				} else {
-					self.head = chum.next
-				}
-				if chum == self.last {
-					self.last = chum.prev
-				}
-				chum.prev = nil
-				chum.next = nil
-				chum.team = nil
-				self.length--
-				if self.length == 0 {
-					self.party.teamsLK.Lock()
-					delete(self.party.teams, self.id)
-					self.party.teamsLK.Unlock()
-					self.id = ""
-				}
-			}
-			self.rwLK.Unlock()
+func (self *party) leave(chum *chum, id string) {
+	self.poollTeam.Put(func() {
+		chum.teamsLK.Lock()
+		if team, ok := chum.teams[id]; ok {
+			delete(chum.teams, id)
+			team.remove(chum)
+		}
+		chum.teamsLK.Unlock()
+	})
+}
+
+func (self *party) leaveAll(chum *chum) {
+	self.poollTeam.Put(func() {
+		chum.teamsLK.Lock()
+		teams := chum.teams
+		chum.teams = nil
+		chum.teamsLK.Unlock()
+		for _, team := range teams {
+			team.remove(chum)
 		}
 	})
 }
 
-func (self *team) broadcast(chum *chum, b []byte, text bool, delay time.Duration) error {
-	header := [4]byte{0x82, 0x7E}
-	if text {
-		header[0] = 0x81
+// 在 poollTeam 中调用，没有成员时从 party 中删除
+func (self *team) remove(chum *chum) {
+	self.rwLK.Lock()
+	delete(self.chums, chum)
+	empty := len(self.chums) == 0
+	self.rwLK.Unlock()
+	if empty {
+		self.party.teamsLK.Lock()
+		if self == self.party.teams[self.id] {
+			delete(self.party.teams, self.id)
+		}
+		self.party.teamsLK.Unlock()
+	}
+}
+
+func (self *team) Id() string {
+	return self.id
+}
+
+func (self *team) Len() int {
+	self.rwLK.RLock()
+	n := len(self.chums)
+	self.rwLK.RUnlock()
+	return n
+}
+
+func (self *team) Chums() []Chum {
+	self.rwLK.RLock()
+	chums := make([]Chum, 0, len(self.chums))
+	for chum := range self.chums {
+		chums = append(chums, chum)
 	}
-	var n int
-	l := len(b)
-	switch {
-	case l < 0x7E:
-		header[1] = byte(l)
-		n = 2
-	case l <= 0xFFFF:
-		header[2] = byte(l >> 8)
-		header[3] = byte(l & 0xFF)
-		n = 4
-	default:
-		return Error_notsupport_length64
+	self.rwLK.RUnlock()
+	return chums
+}
+
+func (self *team) Broadcast(b []byte, text bool, delay time.Duration, opts *BroadcastOptions) error {
+	return self.broadcast(nil, b, text, delay, opts)
+}
+
+func (self *team) broadcast(chum *chum, b []byte, text bool, delay time.Duration, opts *BroadcastOptions) error {
+	bs, cbs, err := self.party.broadcastFrames(b, text)
+	if nil != err {
+		return err
 	}
 	if delay < 0 {
-		bs := PBytes.Get(l+n, l+n)
-		copy(bs, header[:n])
-		copy(bs[n:], b)
-		self.rwLK.RLock()
-		chum := self.head
-		for nil != chum {
-			chum.Write(bs)
-			chum = chum.next
-		}
-		self.rwLK.RUnlock()
-		PBytes.Put(bs)
+		self.send(chum, bs, cbs, opts)
 		return nil
 	} else if delay == 0 {
 		delay = broadcast_delay
 	}
-	// 缓存起来，延迟发送（尽量合并相同的消息）
-	hash := hash_times33(header[:n], b)
+	// 缓存起来，延迟发送
+	p := &pending{sender: chum, bs: bs, cbs: cbs, opts: opts}
+	if nil != opts && opts.Key != "" {
+		self.delayKeyed(opts.Key, p, delay)
+	} else {
+		self.delayUnique(p, delay)
+	}
+	return nil
+}
+
+// 相同 key 的广播只保留最新的，沿用第一个的发送时间
+func (self *team) delayKeyed(key string, p *pending, delay time.Duration) {
 	self.msgLK.Lock()
-	if _, ok := self.msgMap[hash]; ok {
+	if old, ok := self.keyed[key]; ok {
+		bs, cbs := old.bs, old.cbs
+		*old = *p
 		self.msgLK.Unlock()
-		return nil
+		putFrames(bs, cbs)
+		return
 	}
-	self.msgMap[hash] = struct{}{}
+	self.keyed[key] = p
 	self.msgLK.Unlock()
 
-	bs := PBytes.Get(l+n, l+n)
-	copy(bs, header[:n])
-	copy(bs[n:], b)
-
-	timer.After(broadcast_delay, func() {
+	timer.After(delay, func() {
 		self.msgLK.Lock()
-		delete(self.msgMap, hash)
+		delete(self.keyed, key)
+		q := *p
 		self.msgLK.Unlock()
-		self.rwLK.RLock()
-		chum := self.head
-		for nil != chum {
-			chum.Write(bs)
-			chum = chum.next
+		self.send(q.sender, q.bs, q.cbs, q.opts)
+	})
+}
+
+// 完全相同的广播（数据、发送者及 opts 都相同）在发送之前只保留一个
+func (self *team) delayUnique(p *pending, delay time.Duration) {
+	hash := hash_times33(p.bs.b, nil)
+	self.msgLK.Lock()
+	for _, q := range self.msgMap[hash] {
+		if q.sender == p.sender && q.opts.equal(p.opts) && bytes.Equal(q.bs.b, p.bs.b) {
+			self.msgLK.Unlock()
+			putFrames(p.bs, p.cbs)
+			return
+		}
+	}
+	self.msgMap[hash] = append(self.msgMap[hash], p)
+	self.msgLK.Unlock()
+
+	timer.After(delay, func() {
+		self.msgLK.Lock()
+		ps := self.msgMap[hash]
+		for i, q := range ps {
+			if q == p {
+				ps = append(ps[:i], ps[i+1:]...)
+				break
+			}
 		}
-		self.rwLK.RUnlock()
-		PBytes.Put(bs)
+		if len(ps) == 0 {
+			delete(self.msgMap, hash)
+		} else {
+			self.msgMap[hash] = ps
+		}
+		self.msgLK.Unlock()
+		self.send(p.sender, p.bs, p.cbs, p.opts)
 	})
-	return nil
+}
+
+// 发送给匹配 opts 的成员，发送后归还缓冲
+func (self *team) send(sender *chum, bs, cbs *frameBuf, opts *BroadcastOptions) {
+	var failed []*chum
+	var errs []error
+	m := opts.matcher()
+	self.rwLK.RLock()
+	for chum := range self.chums {
+		if m.match(sender, chum) {
+			if err := chum.writeFrames(bs, cbs); nil != err {
+				failed = append(failed, chum)
+				errs = append(errs, err)
+			}
+		}
+	}
+	self.rwLK.RUnlock()
+	// 释放队伍的锁之后再关闭，OnError、OnClose 中可能再次广播给该队伍
+	for i, chum := range failed {
+		chum.writeFailed(errs[i])
+	}
+	putFrames(bs, cbs)
 }
 
 func hash_times33(b1, b2 []byte) int {
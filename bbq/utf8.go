@@ -0,0 +1,75 @@
+package bbq
+
+// 可跨帧的增量 UTF-8 校验（Bjoern Hoehrmann 的 DFA）
+const (
+	utf8_accept = 0
+	utf8_reject = 12
+	// 不需要校验（非文本消息或未开启校验）
+	utf8_none = 0xFF
+)
+
+var (
+	utf8Classes = func() (classes [256]uint8) {
+		for i := 0x80; i < 0x100; i++ {
+			switch {
+			case i <= 0x8F:
+				classes[i] = 1
+			case i <= 0x9F:
+				classes[i] = 9
+			case i <= 0xBF:
+				classes[i] = 7
+			case i <= 0xC1:
+				classes[i] = 8
+			case i <= 0xDF:
+				classes[i] = 2
+			case i == 0xE0:
+				classes[i] = 10
+			case i == 0xED:
+				classes[i] = 4
+			case i <= 0xEF:
+				classes[i] = 3
+			case i == 0xF0:
+				classes[i] = 11
+			case i <= 0xF3:
+				classes[i] = 6
+			case i == 0xF4:
+				classes[i] = 5
+			default:
+				classes[i] = 8
+			}
+		}
+		return
+	}()
+
+	utf8States = [108]uint8{
+		0, 12, 24, 36, 60, 96, 84, 12, 12, 12, 48, 72,
+		12, 12, 12, 12, 12, 12, 12, 12, 12, 12, 12, 12,
+		12, 0, 12, 12, 12, 12, 12, 0, 12, 0, 12, 12,
+		12, 24, 12, 12, 12, 12, 12, 24, 12, 24, 12, 12,
+		12, 12, 12, 12, 12, 12, 12, 24, 12, 12, 12, 12,
+		12, 24, 12, 12, 12, 12, 12, 12, 12, 24, 12, 12,
+		12, 12, 12, 12, 12, 12, 12, 36, 12, 36, 12, 12,
+		12, 36, 12, 12, 12, 12, 12, 36, 12, 36, 12, 12,
+		12, 36, 12, 12, 12, 12, 12, 12, 12, 12, 12, 12,
+	}
+)
+
+// 从 state 开始校验 b，返回新的状态。utf8_accept 表示当前位于字符边界
+func utf8Next(state uint8, b []byte) uint8 {
+	for i, l := 0, len(b); i < l && state != utf8_reject; i++ {
+		state = utf8States[state+utf8Classes[b[i]]]
+	}
+	return state
+}
+
+// 校验文本消息中已读取的数据，final 表示消息的最后一个字节已读取
+func (self *chum) validate(b []byte, final bool) error {
+	if self.utf8 == utf8_none {
+		return nil
+	}
+	self.utf8 = utf8Next(self.utf8, b)
+	if self.utf8 == utf8_reject || (final && self.utf8 != utf8_accept) {
+		return self.fail(CloseType_protocol, CloseCode_invalid, Error_utf8)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package wire
+
+const (
+	action_action  = 0
+	action_length  = 1
+	action_data    = 2
+	action_end     = 3
+	action_discard = 4
+)
+
+// 消息（一帧或多帧的数据）中 action 协议的增量解码
+type ActionDecoder struct {
+	// 返回 action 的类型（ActionType_*），ok 为 false 时返回 Error_action_notfound
+	Lookup func(action uint32) (typ int32, ok bool)
+
+	action uint32
+	length uint32
+	offset uint32 // vlen 已读的数据长度
+	typ    int32
+	state  uint8
+	shift  uint8 // varint 已读的字节数
+	last   bool
+	data   []byte
+}
+
+// 解码 b，返回已使用的字节数及事件。final 为 true 表示 b 是消息最后的数据，
+// 此时需要一直调用（b 为剩余的数据）直到返回 Event_more，之后开始新的消息。
+// Event_data 时 Data 为 b 的一部分
+func (self *ActionDecoder) Decode(b []byte, final bool) (n int, ev int, err error) {
+	switch self.state {
+	case action_action:
+		for n < len(b) {
+			c := b[n]
+			n++
+			if self.shift == MaxActionBytes-1 && c > 0x0F {
+				// 超过 32 位
+				return n, Event_more, Error_action
+			}
+			self.action |= uint32(c&0x7F) << (7 * self.shift)
+			if c&0x80 != 0 {
+				self.shift++
+				continue
+			}
+			self.shift = 0
+			typ, ok := int32(ActionType_discard), false
+			if nil != self.Lookup {
+				typ, ok = self.Lookup(self.action)
+			}
+			if !ok {
+				return n, Event_more, Error_action_notfound
+			}
+			self.typ = typ
+			switch typ {
+			case ActionType_vlen:
+				self.state = action_length
+			case ActionType_all, ActionType_stream:
+				self.state = action_data
+			default:
+				self.state = action_end
+			}
+			return n, Event_action, nil
+		}
+		if final {
+			if self.shift != 0 {
+				return n, Event_more, Error_notenough
+			}
+			// 空消息
+			self.Reset()
+		}
+		return n, Event_more, nil
+	case action_length:
+		for n < len(b) {
+			c := b[n]
+			n++
+			self.length |= uint32(c&0x7F) << (7 * self.shift)
+			if c&0x80 != 0 {
+				self.shift++
+				if self.shift == MaxLengthBytes {
+					return n, Event_more, Error_length
+				}
+				continue
+			}
+			self.shift = 0
+			if self.length == 0 {
+				self.state = action_end
+			} else {
+				self.state = action_data
+			}
+			return n, Event_length, nil
+		}
+		if final {
+			return n, Event_more, Error_notenough
+		}
+		return n, Event_more, nil
+	case action_data:
+		if self.typ == ActionType_vlen {
+			l := self.length - self.offset
+			if uint64(l) > uint64(len(b)) {
+				l = uint32(len(b))
+			}
+			if l == 0 {
+				if final {
+					return 0, Event_more, Error_notenough
+				}
+				return 0, Event_more, nil
+			}
+			self.data = b[:l]
+			self.offset += l
+			self.last = self.offset == self.length
+			if self.last {
+				self.state = action_end
+			}
+			return int(l), Event_data, nil
+		}
+		if len(b) != 0 {
+			self.data = b
+			self.last = final
+			if final {
+				self.state = action_end
+			}
+			return len(b), Event_data, nil
+		}
+		if !final {
+			return 0, Event_more, nil
+		}
+		self.data = nil
+		self.last = true
+		fallthrough
+	case action_end:
+		self.state = action_discard
+		return 0, Event_end, nil
+	default:
+		// 丢弃消息剩余的数据
+		if final {
+			self.Reset()
+		}
+		return len(b), Event_more, nil
+	}
+}
+
+func (self *ActionDecoder) Action() uint32 {
+	return self.action
+}
+
+// action 的类型，Lookup 返回的值
+func (self *ActionDecoder) Type() int32 {
+	return self.typ
+}
+
+// vlen 的长度
+func (self *ActionDecoder) Length() uint32 {
+	return self.length
+}
+
+func (self *ActionDecoder) Data() []byte {
+	return self.data
+}
+
+// Data 是否为消息最后的数据
+func (self *ActionDecoder) Last() bool {
+	return self.last
+}
+
+func (self *ActionDecoder) Reset() {
+	lookup := self.Lookup
+	*self = ActionDecoder{Lookup: lookup}
+}
@@ -0,0 +1,193 @@
+package wire
+
+import (
+	"encoding/binary"
+	"github.com/gobwas/ws"
+)
+
+const (
+	frame_header  = 0
+	frame_payload = 1
+)
+
+// 帧的增量解码。每一帧依次返回一个 Event_header，
+// 及至少一个 Event_payload（最后一个的 End 为 true，空帧时数据为空）
+type FrameDecoder struct {
+	// 严格遵循 RFC 6455：拒绝没有 mask 的帧，校验分片的顺序
+	Strict bool
+	// 允许出现在数据消息第一帧的 rsv 位（如 permessage-deflate 的 0x40）
+	Rsv byte
+	// 单帧数据的最大长度，0 为不限制
+	MaxPayload uint64
+
+	header   Header
+	buf      [MaxHeaderSize]byte
+	n        uint8 // buf 中已读的字节数
+	need     uint8 // 帧头的长度，0 为还未确定
+	state    uint8
+	fragment bool   // 分片的数据消息尚未结束
+	end      bool   // 当前帧已读完
+	offset   uint64 // 当前帧已读的数据长度
+	payload  []byte
+}
+
+// 解码 b，返回已使用的字节数及事件。数据会在 b 中原地去掉 mask，
+// Event_payload 时 Payload 为 b 的一部分
+func (self *FrameDecoder) Decode(b []byte) (n int, ev int, err error) {
+	if self.state == frame_payload {
+		l := self.header.Length - self.offset
+		if l > uint64(len(b)) {
+			l = uint64(len(b))
+		}
+		if l == 0 && self.offset != self.header.Length {
+			return 0, Event_more, nil
+		}
+		self.payload = b[:l]
+		if self.header.Masked {
+			ws.Cipher(self.payload, self.header.Mask, int(self.offset&3))
+		}
+		self.offset += l
+		self.end = self.offset == self.header.Length
+		if self.end {
+			self.state = frame_header
+		}
+		return int(l), Event_payload, nil
+	}
+
+	for self.n < 2 {
+		if n == len(b) {
+			return n, Event_more, nil
+		}
+		self.buf[self.n] = b[n]
+		self.n++
+		n++
+	}
+	if self.need == 0 {
+		if err = self.first(); nil != err {
+			return
+		}
+	}
+	for self.n < self.need {
+		if n == len(b) {
+			return n, Event_more, nil
+		}
+		self.buf[self.n] = b[n]
+		self.n++
+		n++
+	}
+	h := &self.header
+	bs := self.buf[2:self.need]
+	switch h.Length {
+	case 126:
+		h.Length = uint64(binary.BigEndian.Uint16(bs))
+		bs = bs[2:]
+	case 127:
+		h.Length = binary.BigEndian.Uint64(bs)
+		if h.Length>>63 != 0 {
+			// 最高位必须为 0
+			return n, Event_more, Error_notsupport_length64
+		}
+		bs = bs[8:]
+	}
+	if self.MaxPayload != 0 && h.Length > self.MaxPayload {
+		return n, Event_more, Error_too_large
+	}
+	if h.Masked {
+		copy(h.Mask[:], bs)
+	}
+	if h.OpCode&0x8 == 0 {
+		self.fragment = !h.Fin
+	}
+	self.n = 0
+	self.need = 0
+	self.state = frame_payload
+	self.offset = 0
+	self.end = false
+	self.payload = nil
+	return n, Event_header, nil
+}
+
+// 解析头两个字节，确定帧头的长度
+func (self *FrameDecoder) first() error {
+	b0, b1 := self.buf[0], self.buf[1]
+	h := Header{
+		Fin:    b0&0x80 != 0,
+		Rsv:    b0 & 0x70,
+		OpCode: b0 & 0x0F,
+		Masked: b1&0x80 != 0,
+		Length: uint64(b1 & 0x7F),
+	}
+	if h.Rsv != 0 {
+		// 只能出现在数据消息的第一帧
+		if h.Rsv&^self.Rsv != 0 || h.OpCode == 0 || h.OpCode&0x8 != 0 {
+			return Error_notsupport_rsv
+		}
+	}
+	if self.Strict && !h.Masked {
+		return Error_unmasked
+	}
+	switch h.OpCode {
+	case 0x0:
+		if self.Strict && !self.fragment {
+			// 只能跟在未结束的数据帧之后
+			return Error_continuation
+		}
+	case 0x1, 0x2:
+		if self.Strict && self.fragment {
+			// 上一个分片的消息尚未结束
+			return Error_continuation
+		}
+	case 0x8, 0x9, 0xA:
+		if !h.Fin || h.Length > 125 {
+			// 控制帧不能分片，且数据不能超过 125 字节
+			return Error_control
+		}
+	default:
+		return Error_opcode
+	}
+	self.need = 2
+	switch h.Length {
+	case 126:
+		self.need += 2
+	case 127:
+		self.need += 8
+	}
+	if h.Masked {
+		self.need += 4
+	}
+	self.header = h
+	return nil
+}
+
+func (self *FrameDecoder) Header() *Header {
+	return &self.header
+}
+
+func (self *FrameDecoder) Payload() []byte {
+	return self.payload
+}
+
+// 当前帧还未读到的数据长度（不含本次的 Payload）
+func (self *FrameDecoder) Remaining() uint64 {
+	return self.header.Length - self.offset
+}
+
+// 当前帧已读完
+func (self *FrameDecoder) End() bool {
+	return self.end
+}
+
+// 当前帧已读完，且是消息的最后一帧（控制帧总是 true）
+func (self *FrameDecoder) Final() bool {
+	return self.end && self.header.Fin
+}
+
+// 是否在读取帧的数据（帧头已解析，还未读完）
+func (self *FrameDecoder) Reading() bool {
+	return self.state == frame_payload
+}
+
+func (self *FrameDecoder) Reset() {
+	strict, rsv, max := self.Strict, self.Rsv, self.MaxPayload
+	*self = FrameDecoder{Strict: strict, Rsv: rsv, MaxPayload: max}
+}
@@ -0,0 +1,188 @@
+package wire
+
+import (
+	"bytes"
+	"testing"
+)
+
+// 按 split 中的值切分 b，模拟每次读到的数据
+func chunks(b []byte, split []byte) [][]byte {
+	var bs [][]byte
+	for i := 0; len(b) > 0; i++ {
+		l := len(b)
+		if len(split) != 0 {
+			l = int(split[i%len(split)])%len(b) + 1
+		}
+		bs = append(bs, b[:l])
+		b = b[l:]
+	}
+	return bs
+}
+
+func lookup(action uint32) (int32, bool) {
+	switch action % 5 {
+	case 0:
+		return ActionType_discard, true
+	case 1:
+		return ActionType_vlen, true
+	case 2:
+		return ActionType_stream, true
+	case 3:
+		return ActionType_all, true
+	}
+	return 0, false
+}
+
+func FuzzFrameDecoder(f *testing.F) {
+	f.Add([]byte{0x82, 0x85, 1, 2, 3, 4, 5, 6, 7, 8, 9}, []byte{1}, false)
+	f.Add([]byte{0x01, 0x7E, 0x00, 0x02, 'a', 'b', 0x89, 0x00, 0x80, 0x00}, []byte{3, 1}, true)
+	f.Add([]byte{0xC1, 0x7F, 0, 0, 0, 0, 0, 0, 0, 1, 'x'}, []byte{}, false)
+	f.Fuzz(func(t *testing.T, b []byte, split []byte, strict bool) {
+		d := FrameDecoder{Strict: strict, Rsv: 0x40, MaxPayload: 1 << 20}
+		var length, got uint64
+		for _, c := range chunks(b, split) {
+			for {
+				n, ev, err := d.Decode(c)
+				if n < 0 || n > len(c) {
+					t.Fatalf("invalid n %d of %d", n, len(c))
+				}
+				if nil != err {
+					return
+				}
+				c = c[n:]
+				switch ev {
+				case Event_header:
+					length, got = d.Header().Length, 0
+				case Event_payload:
+					got += uint64(len(d.Payload()))
+					if got > length || d.End() != (got == length) {
+						t.Fatalf("payload %d of %d, end %v", got, length, d.End())
+					}
+				}
+				if ev == Event_more {
+					if len(c) != 0 {
+						t.Fatalf("%d bytes left", len(c))
+					}
+					break
+				}
+			}
+		}
+	})
+}
+
+func FuzzActionDecoder(f *testing.F) {
+	f.Add([]byte{0x01, 0x03, 'a', 'b', 'c'}, []byte{2}, true)
+	f.Add([]byte{0x83, 0x01, 'x'}, []byte{}, false)
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x0F}, []byte{1}, true)
+	f.Fuzz(func(t *testing.T, b []byte, split []byte, final bool) {
+		d := ActionDecoder{Lookup: lookup}
+		cs := chunks(b, split)
+		for i, c := range cs {
+			last := final && i == len(cs)-1
+			for {
+				n, ev, err := d.Decode(c, last)
+				if n < 0 || n > len(c) {
+					t.Fatalf("invalid n %d of %d", n, len(c))
+				}
+				if nil != err {
+					return
+				}
+				c = c[n:]
+				if ev == Event_data && d.Type() == ActionType_vlen && len(d.Data()) > int(d.Length()) {
+					t.Fatalf("data %d over length %d", len(d.Data()), d.Length())
+				}
+				if ev == Event_more {
+					if len(c) != 0 {
+						t.Fatalf("%d bytes left", len(c))
+					}
+					break
+				}
+			}
+		}
+	})
+}
+
+// 编码的消息（任意分帧、切分）解码后与原始数据相同
+func FuzzRoundTrip(f *testing.F) {
+	f.Add(uint32(1), []byte("hello"), []byte{2}, []byte{1}, true)
+	f.Add(uint32(0xFFFFFFF3), bytes.Repeat([]byte("x"), 300), []byte{100, 7}, []byte{13}, false)
+	f.Add(uint32(7), []byte{}, []byte{}, []byte{}, true)
+	f.Fuzz(func(t *testing.T, action uint32, data []byte, frames []byte, split []byte, masked bool) {
+		typ, ok := lookup(action)
+		if !ok {
+			return
+		}
+		if typ == ActionType_vlen && len(data) > MaxLength {
+			return
+		}
+		msg := AppendAction(nil, action)
+		if typ == ActionType_vlen {
+			msg, _ = AppendLength(msg, len(data))
+		}
+		if typ != ActionType_discard {
+			msg = append(msg, data...)
+		}
+
+		// 分帧
+		var b []byte
+		h := Header{OpCode: 0x2, Masked: masked, Mask: [4]byte{1, 2, 3, 4}}
+		parts := chunks(msg, frames)
+		for i, p := range parts {
+			h.Fin = i == len(parts)-1
+			b = AppendFrame(b, h, p)
+			h.OpCode = 0
+		}
+		if len(parts) == 0 {
+			h.Fin = true
+			b = AppendFrame(b, h, nil)
+		}
+
+		fd := FrameDecoder{Strict: masked}
+		ad := ActionDecoder{Lookup: lookup}
+		var got []byte
+		var ended, found bool
+		for _, c := range chunks(b, split) {
+			for {
+				n, ev, err := fd.Decode(c)
+				if nil != err {
+					t.Fatal(err)
+				}
+				c = c[n:]
+				if ev == Event_more {
+					break
+				}
+				if ev != Event_payload {
+					continue
+				}
+				p, final := fd.Payload(), fd.Final()
+				for {
+					n, ev, err := ad.Decode(p, final)
+					if nil != err {
+						t.Fatal(err)
+					}
+					p = p[n:]
+					switch ev {
+					case Event_action:
+						found = true
+						if ad.Action() != action || ad.Type() != typ {
+							t.Fatalf("action %d type %d", ad.Action(), ad.Type())
+						}
+					case Event_data:
+						got = append(got, ad.Data()...)
+					case Event_end:
+						ended = true
+					}
+					if ev == Event_more {
+						break
+					}
+				}
+			}
+		}
+		if !found || !ended {
+			t.Fatalf("action %v end %v", found, ended)
+		}
+		if typ != ActionType_discard && !bytes.Equal(got, data) {
+			t.Fatalf("got %q want %q", got, data)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/ikCourage/autumn/timer"
+	"sync"
+	"time"
+)
+
+// RPC 建立在 action 协议之上（ActionType_all）：
+// 请求为 action、varint 请求 id 及数据，
+// 回复为保留的回复 action、varint 请求 id、状态及数据（出错时为错误信息）
+const (
+	RPC_ok    = 0
+	RPC_error = 1
+	// 默认的回复 action
+	RPC_reply = 0xFFFFFFFE
+)
+
+var (
+	Error_timeout = fmt.Errorf("rpc timeout")
+)
+
+// 对端返回的错误
+type RPCError struct {
+	Message string
+}
+
+func (self *RPCError) Error() string {
+	return self.Message
+}
+
+// 等待回复的 RPC 调用，按请求 id 对应回调，服务端与客户端共用
+type Calls struct {
+	lk     sync.Mutex
+	calls  map[uint32]func(resp []byte, err error)
+	id     uint32
+	closed bool
+}
+
+// 追加 RPC 请求的头
+func AppendRequest(dst []byte, action, id uint32) []byte {
+	return AppendAction(AppendAction(dst, action), id)
+}
+
+// 追加 RPC 回复的头
+func AppendReply(dst []byte, reply, id uint32, status byte) []byte {
+	return append(AppendAction(AppendAction(dst, reply), id), status)
+}
+
+// 解析请求（已去掉 action）
+func ReadRequest(b []byte) (id uint32, payload []byte, err error) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 || n > MaxActionBytes || v > 0xFFFFFFFF {
+		return 0, nil, Error_notenough
+	}
+	return uint32(v), b[n:], nil
+}
+
+// 解析回复（已去掉回复的 action）
+func ReadReply(b []byte) (id uint32, status byte, payload []byte, err error) {
+	if id, payload, err = ReadRequest(b); nil != err {
+		return
+	}
+	if len(payload) == 0 {
+		return 0, 0, nil, Error_notenough
+	}
+	return id, payload[0], payload[1:], nil
+}
+
+// 登记调用，返回请求的 id，Close 之后返回 false
+func (self *Calls) Add(callback func(resp []byte, err error)) (id uint32, ok bool) {
+	self.lk.Lock()
+	if self.closed {
+		self.lk.Unlock()
+		return 0, false
+	}
+	self.id++
+	id = self.id
+	if nil == self.calls {
+		self.calls = make(map[uint32]func(resp []byte, err error))
+	}
+	self.calls[id] = callback
+	self.lk.Unlock()
+	return id, true
+}
+
+// 取出 id 的回调，已回调过（回复、超时或关闭）时返回 nil
+func (self *Calls) Take(id uint32) (callback func(resp []byte, err error)) {
+	self.lk.Lock()
+	if callback = self.calls[id]; nil != callback {
+		delete(self.calls, id)
+	}
+	self.lk.Unlock()
+	return
+}
+
+// timeout 后仍未回复时以 Error_timeout 回调，timeout 为 0 时不超时
+func (self *Calls) Expire(id uint32, timeout time.Duration) {
+	if timeout > 0 {
+		timer.After(timeout, func() {
+			if callback := self.Take(id); nil != callback {
+				callback(nil, Error_timeout)
+			}
+		})
+	}
+}
+
+// 解析回复（已去掉回复的 action）并回调，出错时不回调
+func (self *Calls) Reply(b []byte) error {
+	id, status, resp, err := ReadReply(b)
+	if nil != err {
+		return err
+	}
+	if callback := self.Take(id); nil != callback {
+		if status == RPC_ok {
+			callback(resp, nil)
+		} else {
+			callback(nil, &RPCError{Message: string(resp)})
+		}
+	}
+	return nil
+}
+
+// 连接关闭时结束所有未完成的调用，之后 Add 返回 false。
+// 在其它线程以 err 回调，因为关闭时调用者可能持有锁
+func (self *Calls) Close(err error) {
+	self.lk.Lock()
+	calls := self.calls
+	self.calls = nil
+	self.closed = true
+	self.lk.Unlock()
+	for _, callback := range calls {
+		callback := callback
+		timer.After(0, func() {
+			callback(nil, err)
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// wire 是 bbq 使用的 WebSocket 帧及 action 协议的编解码，不依赖连接：
+// 解码器只接收调用者读到的数据（可以任意切分），逐个返回事件，
+// 所以服务端、客户端及测试都可以直接使用。
+//
+// action 协议：每条消息以 7 位 varint 编码的 action（最多 5 字节）开头，
+// ActionType_vlen 之后是 varint 编码的长度（最多 3 字节）及数据，
+// ActionType_all、ActionType_stream 之后直到消息结束都是数据。
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/gobwas/ws"
+)
+
+const (
+	ActionType_discard = 0
+	ActionType_vlen    = -1
+	ActionType_stream  = -2
+	ActionType_all     = -3
+)
+
+// 解码器返回的事件
+const (
+	// 输入已处理完，需要更多的数据
+	Event_more = iota
+	// 帧头解析完毕，FrameDecoder.Header 有效
+	Event_header
+	// 帧的数据（已去掉 mask），FrameDecoder.Payload 有效，可能为空
+	Event_payload
+	// action 解析完毕，ActionDecoder.Action、Type 有效
+	Event_action
+	// vlen 的长度解析完毕，ActionDecoder.Length 有效
+	Event_length
+	// 消息的数据，ActionDecoder.Data 有效
+	Event_data
+	// 消息结束，之后直到消息结束的数据都会被丢弃
+	Event_end
+)
+
+const (
+	// action 的最大字节数
+	MaxActionBytes = 5
+	// 长度的最大字节数
+	MaxLengthBytes = 3
+	// vlen 能表示的最大长度
+	MaxLength = 1<<(7*MaxLengthBytes) - 1
+	// 帧头的最大长度
+	MaxHeaderSize = 14
+)
+
+var (
+	Error_notsupport_rsv      = fmt.Errorf("not support rsv")
+	Error_notsupport_length64 = fmt.Errorf("not support 64-bit length")
+	Error_too_large           = fmt.Errorf("message too large")
+	Error_opcode              = fmt.Errorf("error opcode")
+	Error_control             = fmt.Errorf("invalid control frame")
+	Error_unmasked            = fmt.Errorf("client frame must be masked")
+	Error_continuation        = fmt.Errorf("unexpected continuation frame")
+
+	Error_action_notfound = fmt.Errorf("action not found")
+	Error_action          = fmt.Errorf("action must be less than 32 bits")
+	Error_length          = fmt.Errorf("length must be less than 21 bits")
+	Error_notenough       = fmt.Errorf("the length is not enough")
+)
+
+type Header struct {
+	Fin    bool
+	Rsv    byte // rsv1~3，与帧中的位置相同（0x70）
+	OpCode byte
+	Masked bool
+	Mask   [4]byte
+	Length uint64
+}
+
+// 追加 action 的编码
+func AppendAction(dst []byte, action uint32) []byte {
+	var bs [MaxActionBytes]byte
+	n := binary.PutUvarint(bs[:], uint64(action))
+	return append(dst, bs[:n]...)
+}
+
+// 追加 vlen 长度的编码，length 不能超过 MaxLength
+func AppendLength(dst []byte, length int) ([]byte, error) {
+	if length < 0 || length > MaxLength {
+		return dst, Error_length
+	}
+	var bs [MaxLengthBytes]byte
+	n := binary.PutUvarint(bs[:], uint64(length))
+	return append(dst, bs[:n]...), nil
+}
+
+// 追加帧头
+func AppendHeader(dst []byte, h Header) []byte {
+	var bs [MaxHeaderSize]byte
+	bs[0] = h.OpCode&0x0F | h.Rsv&0x70
+	if h.Fin {
+		bs[0] |= 0x80
+	}
+	n := 2
+	switch {
+	case h.Length < 126:
+		bs[1] = byte(h.Length)
+	case h.Length <= 0xFFFF:
+		bs[1] = 126
+		binary.BigEndian.PutUint16(bs[2:], uint16(h.Length))
+		n += 2
+	default:
+		bs[1] = 127
+		binary.BigEndian.PutUint64(bs[2:], h.Length)
+		n += 8
+	}
+	if h.Masked {
+		bs[1] |= 0x80
+		n += copy(bs[n:], h.Mask[:])
+	}
+	return append(dst, bs[:n]...)
+}
+
+// 追加一帧，h.Length 由 payload 决定，h.Masked 时追加的数据带 mask
+func AppendFrame(dst []byte, h Header, payload []byte) []byte {
+	h.Length = uint64(len(payload))
+	dst = AppendHeader(dst, h)
+	l := len(dst)
+	dst = append(dst, payload...)
+	if h.Masked {
+		ws.Cipher(dst[l:], h.Mask, 0)
+	}
+	return dst
+}
@@ -0,0 +1,25 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package bbq
+
+import (
+	"syscall"
+)
+
+// 依次写入，直到写不完为止
+func writev(fd int, iovs [][]byte) (n int, err error) {
+	for _, b := range iovs {
+		var m int
+		m, err = syscall.Write(fd, b)
+		if m > 0 {
+			n += m
+		}
+		if nil != err || m < len(b) {
+			break
+		}
+	}
+	if n > 0 {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,11 @@
+// +build linux
+
+package bbq
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func writev(fd int, iovs [][]byte) (int, error) {
+	return unix.Writev(fd, iovs)
+}
@@ -22,4 +22,5 @@ type Kpoll interface {
 	Add(fd int, e KEvent) error
 	Mod(fd int, e KEvent) error
 	Del(fd int) error
+	Close() error
 }
@@ -4,11 +4,14 @@ package kpoll
 
 import (
 	"golang.org/x/sys/unix"
+	"sync/atomic"
 	"syscall"
 )
 
 type poll struct {
 	fd      int
+	wfd     [2]int // 用于唤醒 loop
+	closed  uint32
 	handler func([]KEvent_t)
 }
 
@@ -21,6 +24,19 @@ func New(handler func([]KEvent_t)) (Kpoll, error) {
 		fd:      fd,
 		handler: handler,
 	}
+	if err = unix.Pipe2(self.wfd[:], unix.O_NONBLOCK|unix.O_CLOEXEC); nil != err {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err = unix.EpollCtl(fd, unix.EPOLL_CTL_ADD, self.wfd[0], &unix.EpollEvent{
+		Fd:     int32(self.wfd[0]),
+		Events: KEV_READ,
+	}); nil != err {
+		unix.Close(self.wfd[0])
+		unix.Close(self.wfd[1])
+		unix.Close(fd)
+		return nil, err
+	}
 	go self.loop()
 	return self, nil
 }
@@ -46,6 +62,21 @@ func (self *poll) Del(fd int) error {
 	return unix.EpollCtl(self.fd, unix.EPOLL_CTL_DEL, fd, nil)
 }
 
+// 关闭后 loop 会退出，handler 不再被调用
+func (self *poll) Close() error {
+	if !atomic.CompareAndSwapUint32(&self.closed, 0, 1) {
+		return syscall.EINVAL
+	}
+	_, err := unix.Write(self.wfd[1], []byte{0})
+	return err
+}
+
+func (self *poll) release() {
+	unix.Close(self.wfd[0])
+	unix.Close(self.wfd[1])
+	unix.Close(self.fd)
+}
+
 func (self *poll) loop() {
 	const (
 		min = 1 << 10
@@ -60,9 +91,14 @@ __loop:
 		if e, ok := err.(syscall.Errno); ok && e.Temporary() {
 			goto __loop
 		}
+		self.release()
 		return
 	}
 	for i := 0; i < n; i++ {
+		if int(events[i].Fd) == self.wfd[0] {
+			self.release()
+			return
+		}
 		kevs[i].Fd = int(events[i].Fd)
 		kevs[i].Event = KEvent(events[i].Events)
 	}
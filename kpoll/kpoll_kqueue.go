@@ -4,11 +4,14 @@ package kpoll
 
 import (
 	"golang.org/x/sys/unix"
+	"sync/atomic"
 	"syscall"
 )
 
 type poll struct {
 	fd      int
+	wfd     [2]int // 用于唤醒 loop
+	closed  uint32
 	handler func([]KEvent_t)
 }
 
@@ -21,6 +24,17 @@ func New(handler func([]KEvent_t)) (Kpoll, error) {
 		fd:      fd,
 		handler: handler,
 	}
+	if err = unix.Pipe(self.wfd[:]); nil != err {
+		unix.Close(fd)
+		return nil, err
+	}
+	unix.SetNonblock(self.wfd[1], true)
+	if _, err = unix.Kevent(fd, toChanges(uint64(self.wfd[0]), KEV_READ, unix.EV_ADD), nil, nil); nil != err {
+		unix.Close(self.wfd[0])
+		unix.Close(self.wfd[1])
+		unix.Close(fd)
+		return nil, err
+	}
 	go self.loop()
 	return self, nil
 }
@@ -43,6 +57,21 @@ func (self *poll) Del(fd int) error {
 	return err
 }
 
+// 关闭后 loop 会退出，handler 不再被调用
+func (self *poll) Close() error {
+	if !atomic.CompareAndSwapUint32(&self.closed, 0, 1) {
+		return syscall.EINVAL
+	}
+	_, err := unix.Write(self.wfd[1], []byte{0})
+	return err
+}
+
+func (self *poll) release() {
+	unix.Close(self.wfd[0])
+	unix.Close(self.wfd[1])
+	unix.Close(self.fd)
+}
+
 func (self *poll) loop() {
 	const (
 		min = 1 << 10
@@ -57,9 +86,14 @@ __loop:
 		if e, ok := err.(syscall.Errno); ok && e.Temporary() {
 			goto __loop
 		}
+		self.release()
 		return
 	}
 	for i := 0; i < n; i++ {
+		if int(events[i].Ident) == self.wfd[0] {
+			self.release()
+			return
+		}
 		kevs[i].Fd = int(events[i].Ident)
 		kevs[i].Event = KEvent(toKEvent(events[i].Filter, events[i].Flags))
 	}
@@ -2,7 +2,9 @@ package pooll
 
 import (
 	"fmt"
+	"os"
 	"runtime"
+	"runtime/debug"
 	"sync"
 )
 
@@ -22,6 +24,7 @@ type poollTask struct {
 	working int
 	release bool
 	handler func(v interface{})
+	onPanic func(task interface{}, err interface{}, stack []byte)
 }
 
 type Pooll interface {
@@ -33,10 +36,17 @@ type Config struct {
 	Max     int
 	Lazy    bool
 	Handler func(v interface{})
+	// 任务 panic 时调用（worker 会继续执行后续的任务），nil 为 DefaultPanicHandler
+	PanicHandler func(task interface{}, err interface{}, stack []byte)
 }
 
 var (
 	defaultConfig = &Config{}
+
+	// 没有配置 PanicHandler 时使用（包括 timer.After 的函数），输出到 stderr
+	DefaultPanicHandler = func(task interface{}, err interface{}, stack []byte) {
+		fmt.Fprintf(os.Stderr, "pooll: panic in task %T: %v\n%s", task, err, stack)
+	}
 )
 
 func New(config *Config) Pooll {
@@ -50,6 +60,7 @@ func New(config *Config) Pooll {
 	self := &poollTask{
 		max:     max,
 		handler: config.Handler,
+		onPanic: config.PanicHandler,
 	}
 	self.cond = sync.NewCond(&self.lk)
 	if !config.Lazy {
@@ -86,16 +97,14 @@ func (self *poollTask) Put(v interface{}) error {
 	}
 	self.last = task
 	self.length++
-	if self.length < self.worker-self.working {
-		self.lk.Unlock()
-		self.cond.Signal()
-	} else {
-		if self.worker < self.max {
-			self.worker++
-			go self.loop(self.worker - 1)
-		}
-		self.lk.Unlock()
+	if self.length > self.worker-self.working && self.worker < self.max {
+		// 空闲的 worker 不够
+		self.worker++
+		go self.loop(self.worker - 1)
 	}
+	self.lk.Unlock()
+	// 总是唤醒，否则任务数恰好等于空闲的 worker 数时会一直等待
+	self.cond.Signal()
 	return nil
 }
 
@@ -124,11 +133,25 @@ __retry:
 	self.head = task.next
 	self.length--
 	self.cond.L.Unlock()
+	self.run(task.args)
+	b = false
+	goto __loop
+}
+
+// 执行任务，panic 不会影响 worker 及其它任务
+func (self *poollTask) run(v interface{}) {
+	defer func() {
+		if err := recover(); nil != err {
+			onPanic := self.onPanic
+			if nil == onPanic {
+				onPanic = DefaultPanicHandler
+			}
+			onPanic(v, err, debug.Stack())
+		}
+	}()
 	if nil != self.handler {
-		self.handler(task.args)
+		self.handler(v)
 	} else {
-		task.args.(func())()
+		v.(func())()
 	}
-	b = false
-	goto __loop
 }